@@ -0,0 +1,312 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes the period to sleep between two attempts.
+type Backoff interface {
+	// NextBackOff returns the period to sleep after the given attempt,
+	// which starts at 1.
+	NextBackOff(attempt int) time.Duration
+	// Reset clears any state kept between two calls to NextBackOff.
+	// It is called before each retry sequence.
+	Reset()
+}
+
+// ConstantBackoff sleeps the same period between all attempts.
+// If it is <= 0, DefaultPeriod() is used.
+type ConstantBackoff time.Duration
+
+// NextBackOff returns the period to sleep after the given attempt.
+func (b ConstantBackoff) NextBackOff(attempt int) time.Duration {
+	if b <= 0 {
+		return DefaultPeriod()
+	}
+	return time.Duration(b)
+}
+
+// Reset does nothing; ConstantBackoff keeps no state.
+func (ConstantBackoff) Reset() {}
+
+// immediate does not sleep between two attempts.
+type immediate struct{}
+
+func (immediate) NextBackOff(int) time.Duration { return 0 }
+func (immediate) Reset()                        {}
+
+// LinearBackoff grows the period between two attempts by Step:
+// Step, 2*Step, 3*Step, ... up to MaxInterval, if MaxInterval > 0.
+// If Step <= 0, DefaultPeriod() is used.
+type LinearBackoff struct {
+	Step        time.Duration
+	MaxInterval time.Duration
+}
+
+// NextBackOff returns the period to sleep after the given attempt,
+// which starts at 1.
+func (b *LinearBackoff) NextBackOff(attempt int) time.Duration {
+	step := b.Step
+	if step <= 0 {
+		step = DefaultPeriod()
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := time.Duration(math.MaxInt64)
+	if int64(attempt) <= math.MaxInt64/int64(step) {
+		d = step * time.Duration(attempt)
+	}
+	if b.MaxInterval > 0 && d > b.MaxInterval {
+		return b.MaxInterval
+	}
+	return d
+}
+
+// Reset does nothing; LinearBackoff keeps no state.
+func (*LinearBackoff) Reset() {}
+
+// FibonacciBackoff grows the period between two attempts following
+// the Fibonacci sequence, scaled by Base: Base, Base, 2*Base, 3*Base,
+// 5*Base, ... up to MaxInterval, if MaxInterval > 0.
+// If Base <= 0, DefaultPeriod() is used.
+type FibonacciBackoff struct {
+	Base        time.Duration
+	MaxInterval time.Duration
+}
+
+// NextBackOff returns the period to sleep after the given attempt,
+// which starts at 1.
+func (b *FibonacciBackoff) NextBackOff(attempt int) time.Duration {
+	base := b.Base
+	if base <= 0 {
+		base = DefaultPeriod()
+	}
+	max := b.MaxInterval
+	if max <= 0 {
+		max = math.MaxInt64
+	}
+	prev, cur := time.Duration(0), base
+	for i := 1; i < attempt; i++ {
+		if cur > max-prev {
+			return max
+		}
+		prev, cur = cur, prev+cur
+	}
+	if cur > max {
+		return max
+	}
+	return cur
+}
+
+// Reset does nothing; FibonacciBackoff keeps no state.
+func (*FibonacciBackoff) Reset() {}
+
+// DecorrelatedJitterBackoff implements the "decorrelated jitter" algorithm:
+// each period is a random value between Base and three times the previous
+// period, up to Cap, if Cap > 0. If Base <= 0,
+// DefaultPeriod() is used.
+//
+// Since it keeps the previous period, each retry sequence needs its own
+// instance; and it is not safe for concurrent use. A Retryer copies it,
+// for each call, so one Retryer can still be shared.
+// Rand is the source of randomness; if nil, the global source is used.
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	Cap  time.Duration
+	Rand *rand.Rand
+
+	prev time.Duration
+}
+
+// NextBackOff returns the period to sleep after the next attempt.
+func (b *DecorrelatedJitterBackoff) NextBackOff(attempt int) time.Duration {
+	base := b.Base
+	if base <= 0 {
+		base = DefaultPeriod()
+	}
+	if b.prev < base {
+		b.prev = base
+	}
+	hi := time.Duration(math.MaxInt64)
+	if b.prev <= math.MaxInt64/3 {
+		hi = b.prev * 3
+	}
+	d := base
+	if n := int64(hi - base); n > 0 {
+		if b.Rand != nil {
+			d += time.Duration(b.Rand.Int63n(n))
+		} else {
+			d += time.Duration(rand.Int63n(n))
+		}
+	}
+	if b.Cap > 0 && d > b.Cap {
+		d = b.Cap
+	}
+	b.prev = d
+	return d
+}
+
+// Reset starts over from Base.
+func (b *DecorrelatedJitterBackoff) Reset() { b.prev = 0 }
+
+// ExponentialBackoff grows the period between two attempts by Multiplier,
+// up to MaxInterval. If Multiplier <= 1, the period stays fixed.
+// If Period <= 0, DefaultPeriod() is used.
+//
+// If RandomizationFactor > 0, each period is randomized to a value in
+// [period - RandomizationFactor*period, period + RandomizationFactor*period].
+// Rand is the source of randomness; if nil, the global source is used.
+// A *rand.Rand is not safe for concurrent use, so do not share one between
+// concurrent retries.
+type ExponentialBackoff struct {
+	Period              time.Duration
+	Multiplier          float64
+	MaxInterval         time.Duration
+	RandomizationFactor float64
+	Rand                *rand.Rand
+}
+
+// NextBackOff returns the period to sleep after the given attempt,
+// which starts at 1.
+func (b *ExponentialBackoff) NextBackOff(attempt int) time.Duration {
+	p := b.Period
+	if p <= 0 {
+		p = DefaultPeriod()
+	}
+	return randomize(
+		exponential(p, b.Multiplier, b.MaxInterval, attempt),
+		b.RandomizationFactor,
+		b.Rand)
+}
+
+// Reset does nothing; ExponentialBackoff keeps no state.
+func (*ExponentialBackoff) Reset() {}
+
+// exponential returns period * multiplier^(attempt-1), rounded to
+// the nearest nanosecond, and capped at max if max > 0.
+func exponential(period time.Duration, multiplier float64, max time.Duration, attempt int) time.Duration {
+	d := float64(period)
+	if multiplier > 1 && attempt > 1 {
+		d *= math.Pow(multiplier, float64(attempt-1))
+	}
+	if max > 0 && d > float64(max) {
+		return max
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(math.Round(d))
+}
+
+// randomizes reports whether b randomizes its periods itself.
+func randomizes(b Backoff) bool {
+	switch b := b.(type) {
+	case *ExponentialBackoff:
+		return b.RandomizationFactor > 0
+	case *DecorrelatedJitterBackoff:
+		return true
+	}
+	return false
+}
+
+// randomize returns a random duration in [d - factor*d, d + factor*d].
+// The factor is capped at 1.
+func randomize(d time.Duration, factor float64, rnd *rand.Rand) time.Duration {
+	if factor <= 0 || d <= 0 {
+		return d
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	var r float64
+	if rnd != nil {
+		r = rnd.Float64()
+	} else {
+		r = rand.Float64()
+	}
+	delta := factor * float64(d)
+	v := float64(d) - delta + r*2*delta
+	if v >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(v)
+}
+
+// FullJitter returns a random period in [0, d), the "full jitter" of
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/.
+// It is meant to randomize the period computed by a custom Backoff, or
+// a PeriodFunc. rnd is the source of randomness; if nil, the global source
+// is used. If d <= 0, it returns 0.
+func FullJitter(d time.Duration, rnd *rand.Rand) time.Duration {
+	return jitter(d, rnd)
+}
+
+// EqualJitter returns a random period in [d/2, d), the "equal jitter"
+// of the same article as FullJitter; so it keeps at least half of d.
+// rnd is the source of randomness; if nil, the global source is used.
+// If d <= 0, it returns 0.
+func EqualJitter(d time.Duration, rnd *rand.Rand) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + jitter(d-half, rnd)
+}
+
+// jitter returns a random duration in [0, window).
+func jitter(window time.Duration, rnd *rand.Rand) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	if rnd != nil {
+		return time.Duration(rnd.Int63n(int64(window)))
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// WeightedDelay is a candidate period for WeightedPeriod, chosen with
+// a probability proportional to its Weight.
+type WeightedDelay struct {
+	Delay  time.Duration
+	Weight float64
+}
+
+// WeightedPeriod returns a PeriodFunc that picks the period after each
+// failed attempt randomly among delays, using their weights; like 70% of
+// the time a short period, and 30% a long one. Candidates with a weight
+// <= 0 are never picked; if there are none left, it does not sleep.
+// rnd is the source of randomness; if nil, the global source is used.
+// A *rand.Rand is not safe for concurrent use, so do not share one between
+// concurrent retries.
+func WeightedPeriod(delays []WeightedDelay, rnd *rand.Rand) PeriodFunc {
+	var candidates []WeightedDelay
+	var total float64
+	for _, d := range delays {
+		if d.Weight > 0 && !math.IsInf(d.Weight, 0) {
+			candidates = append(candidates, d)
+			total += d.Weight
+		}
+	}
+	return func(int, error) time.Duration {
+		if len(candidates) == 0 {
+			return 0
+		}
+		var r float64
+		if rnd != nil {
+			r = rnd.Float64()
+		} else {
+			r = rand.Float64()
+		}
+		r *= total
+		for _, c := range candidates {
+			if r < c.Weight {
+				return c.Delay
+			}
+			r -= c.Weight
+		}
+		return candidates[len(candidates)-1].Delay
+	}
+}
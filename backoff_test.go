@@ -0,0 +1,324 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ Backoff = ConstantBackoff(0)
+	_ Backoff = &LinearBackoff{}
+	_ Backoff = &FibonacciBackoff{}
+	_ Backoff = &DecorrelatedJitterBackoff{}
+	_ Backoff = &ExponentialBackoff{}
+)
+
+func TestConstantBackoff(t *testing.T) {
+	b := ConstantBackoff(time.Millisecond * 50)
+	assert.Equal(t, time.Millisecond*50, b.NextBackOff(1))
+	assert.Equal(t, time.Millisecond*50, b.NextBackOff(10))
+	assert.Equal(t, time.Second*5, ConstantBackoff(0).NextBackOff(1))
+}
+
+func TestLinearBackoff(t *testing.T) {
+	b := &LinearBackoff{Step: time.Millisecond * 50}
+	var got []time.Duration
+	for attempt := 1; attempt <= 4; attempt++ {
+		got = append(got, b.NextBackOff(attempt))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 50,
+		time.Millisecond * 100,
+		time.Millisecond * 150,
+		time.Millisecond * 200,
+	}, got)
+}
+
+func TestLinearBackoffMaxInterval(t *testing.T) {
+	b := &LinearBackoff{Step: time.Millisecond * 50, MaxInterval: time.Millisecond * 120}
+	var got []time.Duration
+	for attempt := 1; attempt <= 4; attempt++ {
+		got = append(got, b.NextBackOff(attempt))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 50,
+		time.Millisecond * 100,
+		time.Millisecond * 120,
+		time.Millisecond * 120,
+	}, got)
+	assert.Equal(t, time.Millisecond*120, b.NextBackOff(math.MaxInt32))
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	b := &FibonacciBackoff{Base: time.Millisecond * 10}
+	var got []time.Duration
+	for attempt := 1; attempt <= 8; attempt++ {
+		got = append(got, b.NextBackOff(attempt))
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{10 * ms, 10 * ms, 20 * ms, 30 * ms, 50 * ms, 80 * ms, 130 * ms, 210 * ms}, got)
+	assert.Equal(t, time.Duration(math.MaxInt64), b.NextBackOff(1000))
+}
+
+func TestFibonacciBackoffMaxInterval(t *testing.T) {
+	b := &FibonacciBackoff{Base: time.Millisecond * 10, MaxInterval: time.Millisecond * 60}
+	var got []time.Duration
+	for attempt := 1; attempt <= 7; attempt++ {
+		got = append(got, b.NextBackOff(attempt))
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{10 * ms, 10 * ms, 20 * ms, 30 * ms, 50 * ms, 60 * ms, 60 * ms}, got)
+	assert.Equal(t, 60*ms, b.NextBackOff(math.MaxInt32))
+	assert.Equal(t, time.Second*5, (&FibonacciBackoff{}).NextBackOff(1))
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	base, ceiling := time.Millisecond*10, time.Millisecond*500
+	b := &DecorrelatedJitterBackoff{Base: base, Cap: ceiling, Rand: rand.New(rand.NewSource(1))}
+	prev := base
+	for attempt := 1; attempt <= 100; attempt++ {
+		d := b.NextBackOff(attempt)
+		assert.True(t, d >= base, d)
+		assert.True(t, d <= ceiling, d)
+		assert.True(t, d < prev*3 || d == ceiling, d)
+		prev = d
+	}
+}
+
+func TestDecorrelatedJitterBackoffSeeded(t *testing.T) {
+	b1 := &DecorrelatedJitterBackoff{Base: time.Millisecond, Cap: time.Second, Rand: rand.New(rand.NewSource(7))}
+	b2 := &DecorrelatedJitterBackoff{Base: time.Millisecond, Cap: time.Second, Rand: rand.New(rand.NewSource(7))}
+	for attempt := 1; attempt <= 10; attempt++ {
+		assert.Equal(t, b1.NextBackOff(attempt), b2.NextBackOff(attempt))
+	}
+}
+
+func TestDecorrelatedJitterBackoffReset(t *testing.T) {
+	b := &DecorrelatedJitterBackoff{Base: time.Millisecond, Cap: time.Hour, Rand: rand.New(rand.NewSource(1))}
+	for attempt := 1; attempt <= 20; attempt++ {
+		b.NextBackOff(attempt)
+	}
+	assert.True(t, b.prev > time.Millisecond*3)
+	b.Reset()
+	assert.True(t, b.NextBackOff(1) < time.Millisecond*3)
+}
+
+type countingBackoff struct {
+	ConstantBackoff
+	resets int
+}
+
+func (b *countingBackoff) Reset() { b.resets++ }
+
+func TestRetryerResetsBackoff(t *testing.T) {
+	b := &countingBackoff{ConstantBackoff: ConstantBackoff(time.Millisecond)}
+	r := mustRetryer(WithMaxAttempts(2), WithBackoff(b))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, 2, b.resets)
+}
+
+func TestRetryerResetsDecorrelatedJitter(t *testing.T) {
+	s := &fakeSleeper{}
+	b := &DecorrelatedJitterBackoff{Base: time.Millisecond, Cap: time.Hour, Rand: rand.New(rand.NewSource(1))}
+	r := mustRetryer(WithMaxAttempts(20), WithBackoff(b), WithSleeper(s))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	s.delays = nil
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.True(t, s.delays[0] < time.Millisecond*3, s.delays[0])
+}
+
+func TestExponential(t *testing.T) {
+	p := time.Millisecond * 50
+	var got []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		got = append(got, exponential(p, 2, 0, attempt))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 50,
+		time.Millisecond * 100,
+		time.Millisecond * 200,
+		time.Millisecond * 400,
+		time.Millisecond * 800,
+	}, got)
+}
+
+func TestExponentialMaxInterval(t *testing.T) {
+	p := time.Millisecond * 50
+	assert.Equal(t, time.Millisecond*200, exponential(p, 2, time.Millisecond*200, 3))
+	assert.Equal(t, time.Millisecond*200, exponential(p, 2, time.Millisecond*200, 10))
+	assert.Equal(t, time.Second*5, exponential(p, 2, time.Second*5, 1000))
+}
+
+func TestExponentialFixed(t *testing.T) {
+	p := time.Millisecond * 50
+	assert.Equal(t, p, exponential(p, 0, 0, 1))
+	assert.Equal(t, p, exponential(p, 0, 0, 10))
+	assert.Equal(t, p, exponential(p, 1, 0, 10))
+}
+
+func TestExponentialBackoffDefaultPeriod(t *testing.T) {
+	b := &ExponentialBackoff{}
+	assert.Equal(t, time.Second*5, b.NextBackOff(1))
+	assert.Equal(t, time.Second*5, b.NextBackOff(3))
+}
+
+func TestRandomize(t *testing.T) {
+	d := time.Millisecond * 100
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		v := randomize(d, 0.5, rnd)
+		assert.True(t, v >= time.Millisecond*50 && v <= time.Millisecond*150, v)
+	}
+	assert.Equal(t, d, randomize(d, 0, rnd))
+}
+
+func TestRandomizeSeeded(t *testing.T) {
+	d := time.Millisecond * 100
+	r1, r2 := rand.New(rand.NewSource(42)), rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, randomize(d, 0.5, r1), randomize(d, 0.5, r2))
+	}
+}
+
+func TestExponentialBackoffRandomizationFactor(t *testing.T) {
+	b := &ExponentialBackoff{
+		Period:              time.Millisecond * 100,
+		Multiplier:          2,
+		RandomizationFactor: 0.5,
+		Rand:                rand.New(rand.NewSource(1)),
+	}
+	for attempt := 1; attempt <= 5; attempt++ {
+		base := exponential(b.Period, b.Multiplier, 0, attempt)
+		v := b.NextBackOff(attempt)
+		assert.True(t, v >= base/2 && v <= base+base/2, v)
+	}
+}
+
+func TestRetryerMaxIntervalBeforeJitter(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(40),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond * 100, Multiplier: 2}),
+		WithMaxInterval(time.Millisecond*400),
+		WithRandomizationFactor(0.5),
+		WithRand(rand.New(rand.NewSource(1))),
+		WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	above := 0
+	for _, d := range s.delays[3:] {
+		assert.True(t, d >= time.Millisecond*200 && d <= time.Millisecond*600, d)
+		if d > time.Millisecond*400 {
+			above++
+		}
+	}
+	assert.True(t, above > 0)
+	assert.True(t, above < len(s.delays)-3)
+}
+
+func TestRetryBackoffLinear(t *testing.T) {
+	var calls []time.Time
+	RetryBackoff(func() error {
+		calls = append(calls, time.Now())
+		return errors.Errorf("DUMMY")
+	},
+		3,
+		nil,
+		&LinearBackoff{Step: time.Millisecond * 30})
+	assert.Equal(t, 3, len(calls))
+	assert.InDelta(t, float64(time.Millisecond*30), float64(calls[1].Sub(calls[0])), float64(time.Millisecond*15))
+	assert.InDelta(t, float64(time.Millisecond*60), float64(calls[2].Sub(calls[1])), float64(time.Millisecond*15))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var calls []time.Time
+	RetryBackoff(func() error {
+		calls = append(calls, time.Now())
+		return errors.Errorf("DUMMY")
+	},
+		4,
+		nil,
+		&ExponentialBackoff{Period: time.Millisecond * 20, Multiplier: 2})
+	assert.Equal(t, 4, len(calls))
+	for i, expected := range []time.Duration{
+		time.Millisecond * 20,
+		time.Millisecond * 40,
+		time.Millisecond * 80,
+	} {
+		assert.InDelta(t, float64(expected), float64(calls[i+1].Sub(calls[i])), float64(time.Millisecond*15))
+	}
+}
+
+func TestFullJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	d := time.Millisecond * 100
+	for i := 0; i < 100; i++ {
+		j := FullJitter(d, rnd)
+		assert.True(t, j >= 0 && j < d)
+	}
+	assert.Equal(t, FullJitter(d, rand.New(rand.NewSource(3))), FullJitter(d, rand.New(rand.NewSource(3))))
+	assert.Equal(t, time.Duration(0), FullJitter(0, nil))
+	assert.Equal(t, time.Duration(0), FullJitter(-time.Second, nil))
+	j := FullJitter(d, nil)
+	assert.True(t, j >= 0 && j < d)
+}
+
+func TestEqualJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	d := time.Millisecond * 100
+	for i := 0; i < 100; i++ {
+		j := EqualJitter(d, rnd)
+		assert.True(t, j >= d/2 && j < d)
+	}
+	assert.Equal(t, EqualJitter(d, rand.New(rand.NewSource(3))), EqualJitter(d, rand.New(rand.NewSource(3))))
+	assert.Equal(t, time.Duration(0), EqualJitter(0, nil))
+	assert.Equal(t, time.Duration(0), EqualJitter(1, nil))
+}
+
+func TestWeightedPeriod(t *testing.T) {
+	short, long := time.Millisecond*10, time.Second
+	f := WeightedPeriod([]WeightedDelay{
+		{Delay: short, Weight: 7},
+		{Delay: long, Weight: 3},
+		{Delay: time.Hour, Weight: 0},
+	}, rand.New(rand.NewSource(1)))
+	counts := map[time.Duration]int{}
+	for i := 1; i <= 10000; i++ {
+		counts[f(i, nil)]++
+	}
+	assert.Equal(t, 2, len(counts))
+	assert.InDelta(t, 7000, counts[short], 300)
+	assert.InDelta(t, 3000, counts[long], 300)
+
+	delays := []WeightedDelay{{Delay: short, Weight: 1}, {Delay: long, Weight: 1}}
+	f1 := WeightedPeriod(delays, rand.New(rand.NewSource(3)))
+	f2 := WeightedPeriod(delays, rand.New(rand.NewSource(3)))
+	for i := 1; i <= 10; i++ {
+		assert.Equal(t, f1(i, nil), f2(i, nil))
+	}
+
+	assert.Equal(t, time.Duration(0), WeightedPeriod(nil, nil)(1, nil))
+	assert.Equal(t, time.Duration(0), WeightedPeriod([]WeightedDelay{{Delay: long, Weight: -1}}, nil)(1, nil))
+	assert.Equal(t, long, WeightedPeriod([]WeightedDelay{{Delay: long, Weight: 1}}, nil)(1, nil))
+}
+
+func TestRetryerWeightedPeriod(t *testing.T) {
+	s := &fakeSleeper{}
+	r := mustRetryer(
+		WithMaxAttempts(4),
+		WithSleeper(s),
+		WithPeriodFunc(WeightedPeriod([]WeightedDelay{
+			{Delay: time.Millisecond, Weight: 1},
+			{Delay: time.Second, Weight: 1},
+		}, rand.New(rand.NewSource(1)))))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, 3, len(s.delays))
+	for _, d := range s.delays {
+		assert.True(t, d == time.Millisecond || d == time.Second)
+	}
+}
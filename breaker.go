@@ -0,0 +1,117 @@
+package retry
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of a Retryer.
+// See WithCircuitBreaker.
+type CircuitState int
+
+// States of a circuit breaker.
+const (
+	// CircuitClosed lets all attempts run.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails all attempts fast, without running f,
+	// until the cooldown has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a single trial attempt run; if it succeeds,
+	// the circuit is closed again, otherwise it is opened again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// WithCircuitBreaker makes the Retryer track the consecutive failed
+// attempts, across all its calls. Once there are threshold of them,
+// the circuit is opened; the current call stops retrying, and the later
+// ones fail fast with ErrCircuitOpen, without running f, until cooldown
+// has passed. Then a single trial attempt is let through; if it succeeds,
+// the circuit is closed again, otherwise it is opened for another cooldown.
+// threshold must be positive, and cooldown must not be negative.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(r *Retryer) error {
+		if threshold <= 0 {
+			return fmt.Errorf("%w: circuit breaker threshold %d is not positive", ErrInvalidOption, threshold)
+		}
+		if cooldown < 0 {
+			return fmt.Errorf("%w: negative circuit breaker cooldown %v", ErrInvalidOption, cooldown)
+		}
+		r.breaker = &breaker{threshold: threshold, cooldown: cooldown}
+		return nil
+	}
+}
+
+// CircuitState returns the current state of the circuit breaker.
+// Without WithCircuitBreaker, it is always CircuitClosed.
+func (r *Retryer) CircuitState() CircuitState {
+	if r.breaker == nil {
+		return CircuitClosed
+	}
+	return r.breaker.current()
+}
+
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     CircuitState
+	since     time.Time
+}
+
+func (b *breaker) current() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen && time.Since(b.since) >= b.cooldown {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether an attempt may run. While half-open, only
+// one trial runs per cooldown; so a trial that never reports back,
+// like one that panicked with WithNoRecover, does not block the circuit.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitClosed {
+		return nil
+	}
+	if time.Since(b.since) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.state = CircuitHalfOpen
+	b.since = time.Now()
+	return nil
+}
+
+// record counts the result of an attempt, and reports whether
+// the circuit is open afterwards.
+func (b *breaker) record(err error) (open bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.state = CircuitClosed
+		return false
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitOpen
+		b.since = time.Now()
+	}
+	return b.state == CircuitOpen
+}
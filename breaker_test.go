@@ -0,0 +1,76 @@
+package retry
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var sum int64
+	failing := func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithCircuitBreaker(3, time.Millisecond*50),
+		WithSleeper(&fakeSleeper{}))
+	assert.Equal(t, CircuitClosed, r.CircuitState())
+
+	err := r.Do(failing)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+	assert.Equal(t, CircuitOpen, r.CircuitState())
+
+	err = r.Do(failing)
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, int64(3), sum)
+
+	time.Sleep(time.Millisecond * 60)
+	assert.Equal(t, CircuitHalfOpen, r.CircuitState())
+	err = r.Do(failing)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(4), sum)
+	assert.Equal(t, CircuitOpen, r.CircuitState())
+
+	time.Sleep(time.Millisecond * 60)
+	err = r.Do(func() error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitClosed, r.CircuitState())
+}
+
+func TestCircuitBreakerResetOnSuccess(t *testing.T) {
+	var sum int64
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithCircuitBreaker(3, time.Minute),
+		WithSleeper(&fakeSleeper{}))
+	for i := 0; i < 3; i++ {
+		err := r.Do(func() error {
+			if atomic.AddInt64(&sum, 1)%3 != 0 {
+				return errors.Errorf("DUMMY")
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, CircuitClosed, r.CircuitState())
+}
+
+func TestCircuitBreakerInvalid(t *testing.T) {
+	_, err := NewRetryer(WithCircuitBreaker(0, time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+	_, err = NewRetryer(WithCircuitBreaker(1, -time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestCircuitStateString(t *testing.T) {
+	assert.Equal(t, "closed", CircuitClosed.String())
+	assert.Equal(t, "open", CircuitOpen.String())
+	assert.Equal(t, "half-open", CircuitHalfOpen.String())
+	assert.Equal(t, "CircuitState(7)", CircuitState(7).String())
+}
@@ -0,0 +1,190 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStopped is returned when retrying is stopped, using the channel
+// set by WithStopChan.
+var ErrStopped = errors.New("retry: stopped")
+
+// ErrInvalidOption is wrapped by the errors returned from NewRetryer,
+// for invalid options.
+var ErrInvalidOption = errors.New("retry: invalid option")
+
+// ErrTimeout matches, with errors.Is, the TimeoutError returned when
+// an attempt, or the whole retrying, does not finish in time.
+var ErrTimeout = errors.New("retry: timed out")
+
+// TimeoutError is returned when a single attempt does not finish within
+// After, by WithAttemptTimeout, and TryWithTimeout; or, with Overall set,
+// when the whole retrying runs out of time, by WithMaxElapsedTime,
+// RetryWithin, and RetryUntilTime. Then Err is the error of the last
+// attempt; errors.Is and errors.As still see it, by Unwrap. The deadline
+// of a context does not produce it.
+//
+// It implements net.Error, and matches ErrTimeout with errors.Is.
+// Use errors.As to get it:
+//
+//	var te retry.TimeoutError
+//	if errors.As(err, &te) {
+//		log.Println("timed out after", te.After)
+//	}
+type TimeoutError struct {
+	After   time.Duration
+	Overall bool
+	Err     error
+}
+
+func (e TimeoutError) Error() string {
+	if !e.Overall {
+		return fmt.Sprintf("retry: attempt timed out after %v", e.After)
+	}
+	if e.Err == nil {
+		return fmt.Sprintf("retry: timed out after %v", e.After)
+	}
+	return fmt.Sprintf("retry: timed out after %v: %v", e.After, e.Err)
+}
+
+// Unwrap returns Err.
+func (e TimeoutError) Unwrap() error { return e.Err }
+
+// Timeout returns true.
+func (TimeoutError) Timeout() bool { return true }
+
+// Temporary returns true.
+func (TimeoutError) Temporary() bool { return true }
+
+// Is reports whether target is ErrTimeout.
+func (TimeoutError) Is(target error) bool { return target == ErrTimeout }
+
+// ErrCircuitOpen is returned when the circuit breaker of a Retryer
+// is open, without running f. See WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("retry: circuit open")
+
+// ErrRetryNow can be returned by the retried function, or wrapped by
+// its error, to run the next attempt immediately, without sleeping; like
+// when it has just refreshed an expired token. It still counts as a failed
+// attempt.
+var ErrRetryNow = errors.New("retry: retry now")
+
+// ErrExhausted is wrapped by the error returned from a Retryer that
+// ran out of attempts, or of time. See WithExhaustedError.
+var ErrExhausted = errors.New("retry: retries exhausted")
+
+// ErrNotDone is returned by RetryPoll, when f was not done after
+// the last attempt.
+var ErrNotDone = errors.New("retry: not done")
+
+// PermanentError wraps an error that should not be retried.
+// See Permanent.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err, so when it is returned from, or panicked in,
+// the retried function, retrying stops immediately and the wrapped error
+// is returned. If err is nil, it returns nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// RetryableError wraps an error that should be retried.
+// See Retryable.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// Retryable wraps err, to mark it as one to retry, for RetryMarkedOnly.
+// If err is nil, it returns nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// RetryMarkedOnly reports whether err, or any error it wraps, was marked
+// by Retryable. Used with WithRetryIf, only those errors are retried,
+// and any other error stops retrying immediately.
+func RetryMarkedOnly(err error) bool {
+	var e *RetryableError
+	return errors.As(err, &e)
+}
+
+// RetryAfterError is an error that suggests how long to wait before
+// the next attempt, like an HTTP 429 response with a Retry-After header.
+// If an attempt fails with such an error, or an error wrapping one,
+// the suggested period is used instead of the one from the backoff.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// IsPanic reports whether err, or any error it wraps, is a panic
+// recovered by Try, or by the retry functions.
+func IsPanic(err error) bool {
+	var r *PanicError
+	return errors.As(err, &r)
+}
+
+// AsError returns the recovered value of a panic, if err, or any error
+// it wraps, is one: as is if it is an error, otherwise formatted with %v.
+// Other errors, and nil, are returned unchanged.
+func AsError(err error) error {
+	var r *PanicError
+	if !errors.As(err, &r) {
+		return err
+	}
+	if e, ok := r.Value.(error); ok {
+		return e
+	}
+	return fmt.Errorf("%v", r.Value)
+}
+
+// IsTemporary reports whether err, or any error it wraps, including
+// a panicked one, is a timeout, or a temporary error; as reported by
+// the Timeout() and Temporary() methods of net.Error. It can be used
+// with WithRetryIf, to only retry those errors.
+func IsTemporary(err error) bool {
+	var t interface{ Timeout() bool }
+	if errors.As(err, &t) && t.Timeout() {
+		return true
+	}
+	var tmp interface{ Temporary() bool }
+	return errors.As(err, &tmp) && tmp.Temporary()
+}
+
+// asPermanent returns the PermanentError in err, if there is one;
+// including the one panicked in the retried function.
+// asPanic returns the PanicError in err, if any. err is checked for nil
+// first, so a successful attempt does not allocate.
+func asPanic(err error) *PanicError {
+	if err == nil {
+		return nil
+	}
+	var p *PanicError
+	if errors.As(err, &p) {
+		return p
+	}
+	return nil
+}
+
+func asPermanent(err error) *PermanentError {
+	var p *PermanentError
+	if errors.As(err, &p) {
+		return p
+	}
+	return nil
+}
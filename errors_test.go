@@ -0,0 +1,340 @@
+package retry
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermanent(t *testing.T) {
+	var sum int64
+	bad := errors.Errorf("BAD REQUEST")
+	var errs []error
+	startedAt := time.Now()
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		return Permanent(bad)
+	},
+		5,
+		func(err error) { errs = append(errs, err) },
+		time.Second)
+	assert.Equal(t, bad, err)
+	assert.Equal(t, []error{bad}, errs)
+	assert.Equal(t, int64(1), sum)
+	assert.True(t, time.Since(startedAt) < time.Millisecond*100)
+}
+
+func TestPermanentWrapped(t *testing.T) {
+	var sum int64
+	bad := errors.Errorf("BAD REQUEST")
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		return fmt.Errorf("calling: %w", Permanent(bad))
+	},
+		5,
+		nil,
+		time.Second)
+	assert.Equal(t, bad, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestPermanentPanic(t *testing.T) {
+	var sum int64
+	bad := errors.Errorf("BAD REQUEST")
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		panic(Permanent(bad))
+	},
+		5,
+		nil,
+		time.Second)
+	assert.Equal(t, bad, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestPermanentNil(t *testing.T) {
+	assert.Nil(t, Permanent(nil))
+}
+
+func TestRecoveredUnwrap(t *testing.T) {
+	err := Try(func() error {
+		panic(fmt.Errorf("reading: %w", io.EOF))
+	})
+	assert.True(t, errors.Is(err, io.EOF))
+
+	var pe *PermanentError
+	err = Try(func() error {
+		panic(Permanent(io.EOF))
+	})
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, io.EOF, pe.Err)
+}
+
+func TestRecoveredUnwrapNonError(t *testing.T) {
+	err := Try(func() error {
+		panic("X")
+	})
+	assert.Nil(t, errors.Unwrap(err))
+	assert.Equal(t, "X", err.(*PanicError).CausedBy())
+}
+
+func TestPanicErrorAs(t *testing.T) {
+	err := Retry(func() error {
+		panic(42)
+	}, 1, nil)
+	var pe *PanicError
+	assert.True(t, errors.As(errors.Wrap(err, "WRAPPED"), &pe))
+	assert.Equal(t, 42, pe.Value)
+	assert.Equal(t, 42, pe.CausedBy())
+}
+
+func TestPanicErrorJoined(t *testing.T) {
+	a, b := errors.New("A"), errors.New("B")
+	err := Retry(func() error {
+		panic(stderrors.Join(a, b))
+	}, 1, nil)
+	assert.True(t, IsPanic(err))
+	assert.True(t, errors.Is(err, a))
+	assert.True(t, errors.Is(err, b))
+	assert.False(t, errors.Is(err, errors.New("A")))
+}
+
+func TestAsError(t *testing.T) {
+	errDummy := errors.New("DUMMY")
+	assert.Equal(t, errDummy, AsError(Try(func() error { panic(errDummy) })))
+	assert.EqualError(t, AsError(Try(func() error { panic(42) })), "42")
+	assert.Equal(t, errDummy, AsError(errDummy))
+	assert.Nil(t, AsError(nil))
+
+	wrapped := errors.Wrap(Try(func() error { panic("X") }), "WRAPPED")
+	assert.EqualError(t, AsError(wrapped), "X")
+}
+
+func TestRetryMarkedOnly(t *testing.T) {
+	errDummy := errors.New("DUMMY")
+	var sum int64
+	r := mustRetryer(WithMaxAttempts(5), WithRetryIf(RetryMarkedOnly), WithSleeper(&fakeSleeper{}))
+	err := r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return Retryable(errDummy)
+		}
+		return errDummy
+	})
+	assert.Equal(t, errDummy, err)
+	assert.Equal(t, int64(3), sum)
+
+	sum = 0
+	err = r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Wrap(Retryable(errDummy), "WRAPPED")
+	})
+	assert.True(t, errors.Is(err, errDummy))
+	assert.EqualError(t, err, "WRAPPED: DUMMY")
+	assert.Equal(t, int64(5), sum)
+
+	assert.Nil(t, Retryable(nil))
+	assert.False(t, RetryMarkedOnly(nil))
+}
+
+func TestTimeoutError(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	err := TryWithTimeout(func() error {
+		<-release
+		return nil
+	}, time.Millisecond*10)
+	var te TimeoutError
+	assert.True(t, errors.As(errors.Wrap(err, "WRAPPED"), &te))
+	assert.Equal(t, time.Millisecond*10, te.After)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, IsTemporary(err))
+	assert.EqualError(t, err, "retry: attempt timed out after 10ms")
+	assert.False(t, te.Overall)
+	assert.Nil(t, te.Err)
+
+	errDummy := stderrors.New("DUMMY")
+	err = TimeoutError{After: time.Second, Overall: true, Err: errDummy}
+	assert.EqualError(t, err, "retry: timed out after 1s: DUMMY")
+	assert.True(t, errors.Is(err, errDummy))
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.Equal(t, errDummy, stderrors.Unwrap(err))
+
+	var ne net.Error
+	assert.True(t, errors.As(err, &ne))
+	assert.True(t, ne.Timeout())
+}
+
+type tooManyRequests struct{ after time.Duration }
+
+func (e *tooManyRequests) Error() string             { return "429 TOO MANY REQUESTS" }
+func (e *tooManyRequests) RetryAfter() time.Duration { return e.after }
+
+func TestRetryAfter(t *testing.T) {
+	var sum int64
+	var nexts []time.Duration
+	RetryNotify(func() error {
+		switch atomic.AddInt64(&sum, 1) {
+		case 1:
+			return &tooManyRequests{after: time.Millisecond * 30}
+		case 2:
+			return fmt.Errorf("calling: %w", &tooManyRequests{after: time.Millisecond * 20})
+		}
+		return errors.Errorf("DUMMY")
+	},
+		4,
+		func(err error, attempt int, next time.Duration) { nexts = append(nexts, next) },
+		time.Millisecond*10)
+	assert.Equal(t, []time.Duration{
+		time.Millisecond * 30,
+		time.Millisecond * 20,
+		time.Millisecond * 10,
+		0,
+	}, nexts)
+}
+
+func TestIsPanic(t *testing.T) {
+	err := Try(func() error { panic("X") })
+	assert.True(t, IsPanic(err))
+	assert.True(t, IsPanic(fmt.Errorf("wrapped: %w", err)))
+
+	_, err = TryResult(func() (int, error) { panic(io.EOF) })
+	assert.True(t, IsPanic(err))
+
+	assert.False(t, IsPanic(Try(func() error { return io.EOF })))
+	assert.False(t, IsPanic(nil))
+}
+
+func TestIsPanicOnError(t *testing.T) {
+	var panics, errs int64
+	Retry(func() error {
+		if atomic.AddInt64(&errs, 1)%2 == 0 {
+			panic("X")
+		}
+		return errors.Errorf("DUMMY")
+	},
+		4,
+		func(err error) {
+			if IsPanic(err) {
+				atomic.AddInt64(&panics, 1)
+			}
+		},
+		time.Millisecond*10)
+	assert.Equal(t, int64(2), panics)
+}
+
+func TestIsTemporary(t *testing.T) {
+	timeout := &net.DNSError{Err: "timeout", IsTimeout: true}
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+	temporary := &net.DNSError{Err: "temporary", IsTemporary: true}
+
+	assert.True(t, IsTemporary(timeout))
+	assert.True(t, IsTemporary(temporary))
+	assert.True(t, IsTemporary(&net.OpError{Op: "dial", Err: timeout}))
+	assert.True(t, IsTemporary(fmt.Errorf("calling: %w", timeout)))
+	assert.True(t, IsTemporary(Try(func() error { panic(timeout) })))
+	assert.False(t, IsTemporary(notFound))
+	assert.False(t, IsTemporary(io.EOF))
+	assert.False(t, IsTemporary(nil))
+}
+
+func TestIsTemporaryRetryIf(t *testing.T) {
+	var sum int64
+	err := mustRetryer(
+		WithMaxAttempts(5),
+		WithRetryIf(IsTemporary),
+		WithSleeper(&fakeSleeper{})).
+		Do(func() error {
+			if atomic.AddInt64(&sum, 1) < 3 {
+				return &net.DNSError{Err: "timeout", IsTimeout: true}
+			}
+			return &net.DNSError{Err: "no such host", IsNotFound: true}
+		})
+	assert.EqualError(t, err, "lookup : no such host")
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestStackTrace(t *testing.T) {
+	var stack []byte
+	mustRetryer(
+		WithMaxAttempts(1),
+		WithStackTrace(),
+		WithOnError(func(err error) {
+			stack = err.(interface{ Stack() []byte }).Stack()
+			assert.True(t, strings.Contains(err.Error(), "goroutine"))
+			assert.True(t, len(err.Error()) < maxErrorStack+100)
+		})).
+		Do(func() error { panic("X") })
+	assert.True(t, strings.Contains(string(stack), "TestStackTrace"))
+}
+
+func TestStackTraceOff(t *testing.T) {
+	err := Retry(func() error { panic("X") }, 1, nil)
+	assert.Nil(t, err.(*PanicError).Stack())
+	assert.Equal(t, "recovered panic: X", err.Error())
+}
+
+type detailed struct{}
+
+func (detailed) Error() string { return "DETAILED" }
+
+func (d detailed) Format(s fmt.State, verb rune) {
+	if verb == 'v' && s.Flag('+') {
+		fmt.Fprint(s, "DETAILED: MORE")
+		return
+	}
+	fmt.Fprint(s, d.Error())
+}
+
+func TestPanicErrorFormat(t *testing.T) {
+	err := Try(func() error { panic(detailed{}) })
+	assert.Equal(t, "recovered panic: DETAILED", err.Error())
+	assert.Equal(t, "recovered panic: DETAILED", fmt.Sprintf("%v", err))
+	assert.Equal(t, "recovered panic: DETAILED", fmt.Sprintf("%s", err))
+	assert.Equal(t, `"recovered panic: DETAILED"`, fmt.Sprintf("%q", err))
+	assert.Equal(t, "recovered panic: DETAILED: MORE", fmt.Sprintf("%+v", err))
+
+	var stack string
+	mustRetryer(
+		WithMaxAttempts(1),
+		WithStackTrace(),
+		WithOnError(func(err error) { stack = fmt.Sprintf("%+v", err) })).
+		Do(func() error { panic("X") })
+	assert.True(t, strings.HasPrefix(stack, "recovered panic: X\ngoroutine"))
+	assert.True(t, strings.Contains(stack, "TestPanicErrorFormat"))
+}
+
+func ExampleIsPanic() {
+	Retry(func() error {
+		panic("X")
+	},
+		1, func(err error) {
+			if IsPanic(err) {
+				fmt.Println("panic:", err.(interface{ CausedBy() interface{} }).CausedBy())
+			}
+		})
+
+	// Output:
+	// panic: X
+}
+
+func ExamplePermanent() {
+	err := Retry(func() error {
+		fmt.Println("calling")
+		return Permanent(errors.Errorf("BAD REQUEST"))
+	},
+		3, nil,
+		time.Millisecond*50)
+	fmt.Println(err)
+
+	// Output:
+	// calling
+	// BAD REQUEST
+}
@@ -0,0 +1,147 @@
+package retry
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Policy describes a Retryer, as plain data; so it can be loaded from
+// a configuration file, and applied uniformly with NewRetryerFromPolicy.
+// The zero Policy retries forever, sleeping the default period.
+//
+// In JSON, the periods can be strings, like "50ms", as parsed by
+// time.ParseDuration, or numbers of nanoseconds; and are encoded
+// as strings:
+//
+//	{"maxAttempts": 5, "period": "50ms", "multiplier": 2, "maxInterval": "1s"}
+//
+// gopkg.in/yaml.v3 decodes such strings into the periods on its own.
+type Policy struct {
+	// MaxAttempts is the total number of attempts; 0 means no limit.
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts"`
+	// Period is the period after the first failed attempt; 0 means
+	// the default period.
+	Period time.Duration `json:"period" yaml:"period"`
+	// Multiplier grows the period after each failed attempt; 0 or 1
+	// means it stays fixed.
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+	// MaxInterval caps the period; 0 means no cap.
+	MaxInterval time.Duration `json:"maxInterval" yaml:"maxInterval"`
+	// Jitter randomizes each period by up to this fraction of it,
+	// in [0, 1]; see WithRandomizationFactor. 0 means the package
+	// default; see SetRandomizationFactor.
+	Jitter float64 `json:"jitter" yaml:"jitter"`
+}
+
+// policyJSON is the JSON form of a Policy.
+type policyJSON struct {
+	MaxAttempts int      `json:"maxAttempts"`
+	Period      duration `json:"period"`
+	Multiplier  float64  `json:"multiplier"`
+	MaxInterval duration `json:"maxInterval"`
+	Jitter      float64  `json:"jitter"`
+}
+
+// MarshalJSON encodes p, with its periods as strings, like "50ms".
+func (p Policy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(policyJSON{
+		MaxAttempts: p.MaxAttempts,
+		Period:      duration(p.Period),
+		Multiplier:  p.Multiplier,
+		MaxInterval: duration(p.MaxInterval),
+		Jitter:      p.Jitter,
+	})
+}
+
+// UnmarshalJSON decodes p, with its periods as strings, like "50ms",
+// or as numbers of nanoseconds.
+func (p *Policy) UnmarshalJSON(b []byte) error {
+	v := policyJSON{
+		MaxAttempts: p.MaxAttempts,
+		Period:      duration(p.Period),
+		Multiplier:  p.Multiplier,
+		MaxInterval: duration(p.MaxInterval),
+		Jitter:      p.Jitter,
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = Policy{
+		MaxAttempts: v.MaxAttempts,
+		Period:      time.Duration(v.Period),
+		Multiplier:  v.Multiplier,
+		MaxInterval: time.Duration(v.MaxInterval),
+		Jitter:      v.Jitter,
+	}
+	return nil
+}
+
+// duration is a time.Duration in JSON: a string, like "50ms",
+// or a number of nanoseconds.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("retry: invalid duration %s", b)
+		}
+		*d = duration(n)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// NewRetryerFromPolicy creates a Retryer from p, with an ExponentialBackoff,
+// and opts applied after it. It returns an error, wrapping
+// ErrInvalidOption, if a field of p, or an option, is invalid.
+func NewRetryerFromPolicy(p Policy, opts ...Option) (*Retryer, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	maxAttempts := p.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = -1
+	}
+	policy := []Option{
+		WithMaxAttempts(maxAttempts),
+		WithBackoff(&ExponentialBackoff{
+			Period:      p.Period,
+			Multiplier:  p.Multiplier,
+			MaxInterval: p.MaxInterval,
+		}),
+	}
+	if p.Jitter > 0 {
+		policy = append(policy, WithRandomizationFactor(p.Jitter))
+	}
+	return NewRetryer(append(policy, opts...)...)
+}
+
+func (p Policy) validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return fmt.Errorf("%w: negative max attempts %d", ErrInvalidOption, p.MaxAttempts)
+	case p.Period < 0:
+		return fmt.Errorf("%w: negative period %v", ErrInvalidOption, p.Period)
+	case math.IsNaN(p.Multiplier) || math.IsInf(p.Multiplier, 0) ||
+		p.Multiplier < 0 || (p.Multiplier > 0 && p.Multiplier < 1):
+		return fmt.Errorf("%w: multiplier %v is not 0, or at least 1", ErrInvalidOption, p.Multiplier)
+	case p.MaxInterval < 0:
+		return fmt.Errorf("%w: negative max interval %v", ErrInvalidOption, p.MaxInterval)
+	case math.IsNaN(p.Jitter) || p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("%w: jitter %v is not in [0, 1]", ErrInvalidOption, p.Jitter)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package retry
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRetryerFromPolicy(t *testing.T) {
+	var p Policy
+	err := json.Unmarshal([]byte(`{
+		"MaxAttempts": 5,
+		"Period": 10000000,
+		"Multiplier": 2,
+		"MaxInterval": 50000000
+	}`), &p)
+	assert.NoError(t, err)
+
+	r, err := NewRetryerFromPolicy(p, WithSleeper(&fakeSleeper{}))
+	assert.NoError(t, err)
+	s := r.sleeper.(*fakeSleeper)
+	var sum int64
+	err = r.Do(func() error {
+		sum++
+		return errors.Errorf("DUMMY")
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(5), sum)
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{10 * ms, 20 * ms, 40 * ms, 50 * ms}, s.delays)
+}
+
+func TestPolicyJSON(t *testing.T) {
+	var p Policy
+	err := json.Unmarshal([]byte(`{
+		"maxAttempts": 5,
+		"period": "10ms",
+		"multiplier": 1.5,
+		"maxInterval": "1m30s",
+		"jitter": 0.25
+	}`), &p)
+	assert.NoError(t, err)
+	expected := Policy{
+		MaxAttempts: 5,
+		Period:      time.Millisecond * 10,
+		Multiplier:  1.5,
+		MaxInterval: time.Second * 90,
+		Jitter:      0.25,
+	}
+	assert.Equal(t, expected, p)
+
+	b, err := json.Marshal(expected)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"maxAttempts":5,"period":"10ms","multiplier":1.5,"maxInterval":"1m30s","jitter":0.25}`, string(b))
+	var back Policy
+	assert.NoError(t, json.Unmarshal(b, &back))
+	assert.Equal(t, expected, back)
+
+	// in a larger configuration, by pointer or not.
+	var cfg struct {
+		Retry  Policy
+		Others *Policy
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"retry": {"period": "1s"}, "others": {"period": 5}}`), &cfg))
+	assert.Equal(t, Policy{Period: time.Second}, cfg.Retry)
+	assert.Equal(t, &Policy{Period: 5}, cfg.Others)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"period": "SOON"}`), &p))
+	assert.Error(t, json.Unmarshal([]byte(`{"period": true}`), &p))
+}
+
+func TestNewRetryerFromPolicyZero(t *testing.T) {
+	r, err := NewRetryerFromPolicy(Policy{})
+	assert.NoError(t, err)
+	assert.Equal(t, -1, r.maxAttempts)
+	assert.Equal(t, DefaultPeriod(), r.backoff.NextBackOff(3))
+}
+
+func TestNewRetryerFromPolicyInvalid(t *testing.T) {
+	for _, p := range []Policy{
+		{MaxAttempts: -1},
+		{Period: -time.Second},
+		{Multiplier: 0.5},
+		{Multiplier: -2},
+		{Multiplier: math.NaN()},
+		{Multiplier: math.Inf(1)},
+		{MaxInterval: -time.Second},
+		{Jitter: -0.1},
+		{Jitter: 1.5},
+	} {
+		_, err := NewRetryerFromPolicy(p)
+		assert.True(t, errors.Is(err, ErrInvalidOption))
+	}
+	_, err := NewRetryerFromPolicy(Policy{}, WithPeriod(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
@@ -3,54 +3,611 @@
 package retry
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type recovered struct {
-	e interface{}
+const maxErrorStack = 1024
+
+var defaultPeriod = int64(time.Second * 5)
+
+// DefaultPeriod returns the period between two attempts, used when none
+// is given; it is 5 seconds, unless changed by SetDefaultPeriod.
+func DefaultPeriod() time.Duration {
+	return time.Duration(atomic.LoadInt64(&defaultPeriod))
+}
+
+// SetDefaultPeriod changes the default period between two attempts,
+// for all later attempts that do not have an explicit period. It is safe
+// to call concurrently. If d <= 0, the default is set back to 5 seconds.
+func SetDefaultPeriod(d time.Duration) {
+	if d <= 0 {
+		d = time.Second * 5
+	}
+	atomic.StoreInt64(&defaultPeriod, int64(d))
+}
+
+var randomizationFactor atomic.Uint64
+
+// RandomizationFactor returns the factor each period between two attempts
+// is randomized by, when none is given; it is 0, so periods are not
+// randomized, unless changed by SetRandomizationFactor.
+func RandomizationFactor() float64 {
+	return math.Float64frombits(randomizationFactor.Load())
+}
+
+// SetRandomizationFactor changes the default factor each period between
+// two attempts is randomized by, to a value in [period - factor*period,
+// period + factor*period], for all later attempts that do not have one
+// of their own, by WithRandomizationFactor, or by their backoff, like
+// an ExponentialBackoff with a RandomizationFactor; including those of
+// Retry, and the other functions of this package. It is safe to call
+// concurrently. factor is capped at 1; if it is <= 0, or NaN, periods are
+// not randomized.
+func SetRandomizationFactor(factor float64) {
+	if !(factor > 0) {
+		factor = 0
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	randomizationFactor.Store(math.Float64bits(factor))
+}
+
+var panicClassifier atomic.Pointer[func(recovered interface{}) bool]
+
+// SetPanicClassifier registers f, to tell which recovered panics are
+// retried, for all later attempts: when it returns false for a recovered
+// value, like one that shows a bug, retrying stops immediately; and
+// the *PanicError is returned. It is safe to call concurrently. If f is
+// nil, all panics are retried again, which is the default.
+func SetPanicClassifier(f func(recovered interface{}) (retry bool)) {
+	if f == nil {
+		panicClassifier.Store(nil)
+		return
+	}
+	panicClassifier.Store(&f)
 }
 
-func (r *recovered) Error() string         { return "RECOVERED, UNKNOWN ERROR; CALL CausedBy() interface{}" }
-func (r *recovered) CausedBy() interface{} { return r.e }
+// retryPanic reports whether err should be retried, by the registered
+// panic classifier; errors that are not a panic always are.
+func retryPanic(err error) bool {
+	f := panicClassifier.Load()
+	if f == nil {
+		return true
+	}
+	var pe *PanicError
+	if !errors.As(err, &pe) {
+		return true
+	}
+	return (*f)(pe.Value)
+}
+
+// PanicError is the error returned by Try, and the retry functions,
+// when f panics; Value is the recovered value. Use errors.As with
+// a *PanicError to get it:
+//
+//	var pe *retry.PanicError
+//	if errors.As(err, &pe) {
+//		log.Println(pe.Value)
+//	}
+type PanicError struct {
+	Value interface{}
+	stack []byte
+}
+
+func (r *PanicError) Error() string {
+	msg := fmt.Sprintf("recovered panic: %v", r.Value)
+	if len(r.stack) == 0 {
+		return msg
+	}
+	if len(r.stack) > maxErrorStack {
+		return msg + "\n" + string(r.stack[:maxErrorStack]) + "..."
+	}
+	return msg + "\n" + string(r.stack)
+}
+
+// Format formats the error like Error, for the %s and %v verbs. With %+v,
+// the value is formatted with %+v too, so a value that implements
+// fmt.Formatter, like the errors of github.com/pkg/errors, can show its
+// own details; followed by the whole stack trace, if it was captured.
+func (r *PanicError) Format(s fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && s.Flag('+'):
+		fmt.Fprintf(s, "recovered panic: %+v", r.Value)
+		if len(r.stack) > 0 {
+			io.WriteString(s, "\n")
+			s.Write(r.stack)
+		}
+	case verb == 'q':
+		fmt.Fprintf(s, "%q", r.Error())
+	default:
+		io.WriteString(s, r.Error())
+	}
+}
+
+// CausedBy returns the recovered value, the same as Value.
+func (r *PanicError) CausedBy() interface{} { return r.Value }
+
+// Stack returns the stack trace captured when the panic was recovered,
+// or nil if it was not captured. See WithStackTrace.
+func (r *PanicError) Stack() []byte { return r.stack }
+
+// Unwrap returns the recovered value if it is an error, so errors.Is
+// and errors.As can see through it, including into the errors joined by
+// errors.Join; otherwise it returns nil.
+func (r *PanicError) Unwrap() error {
+	err, _ := r.Value.(error)
+	return err
+}
 
 // Try tries to run a function and recovers from a panic, in case
 // one happens, and returns the error, if there are any.
-func Try(f func() error) (errRun error) {
+func Try(f func() error) error {
+	return try(f, false)
+}
+
+func try(f func() error, captureStack bool) (errRun error) {
+	defer func() {
+		if e := recover(); e != nil {
+			r := &PanicError{Value: e}
+			if captureStack {
+				r.stack = debug.Stack()
+			}
+			errRun = r
+		}
+	}()
+	return f()
+}
+
+// TryContext works like Try, but passes ctx to f, so it can abort its
+// own work once ctx is done; f is not stopped otherwise. If ctx is already
+// done, f is not run, and ctx.Err() is returned.
+func TryContext(ctx context.Context, f func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return Try(func() error { return f(ctx) })
+}
+
+// TryWithTimeout works like Try, but returns a TimeoutError if f does not
+// finish within timeout. f is run in a goroutine, which can not be killed;
+// so if f does not finish, the goroutine keeps running until it returns.
+// If timeout <= 0, it works like Try.
+func TryWithTimeout(f func() error, timeout time.Duration) error {
+	if timeout <= 0 {
+		return Try(f)
+	}
+	done := make(chan error, 1)
+	go func() { done <- Try(f) }()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return TimeoutError{After: timeout}
+	}
+}
+
+// TryResult works like Try, for a function that returns a value.
+// If a panic happens, it returns the zero value and the error.
+func TryResult[T any](f func() (T, error)) (res T, errRun error) {
 	defer func() {
 		if e := recover(); e != nil {
-			errRun = &recovered{e: e}
+			var zero T
+			res, errRun = zero, &PanicError{Value: e}
 		}
 	}()
 	return f()
 }
 
 // Retry retries running a function, numberOfRetries times.
+// Despite its name, numberOfRetries is the total number of attempts,
+// including the first one; see RetryTimes.
 // If numberOfRetries < 0, it runs it forever as long as there are
 // any errors. If there are no errors, it will return. If
 // numberOfRetries > 1, it will sleep between two attemps,
-// the default period is 5 seconds.
+// the default period is 5 seconds; see SetDefaultPeriod. If a period <= 0
+// is given, it does not sleep at all, and retries immediately. It returns
+// the error of the last attempt, or nil if an attempt succeeded.
+// If numberOfRetries == 0, f is never run, and an error wrapping
+// ErrInvalidOption is returned; the same for all the functions of this
+// package that take numberOfRetries.
+// An attempt failing with context.Canceled stops retrying immediately;
+// one failing with context.DeadlineExceeded, like the timeout of a single
+// call, is retried like any other. To stop retrying from onError, without
+// waiting for the period to pass, use RetryContext, and cancel its context.
 func Retry(
 	f func() error,
 	numberOfRetries int,
 	onError func(error),
-	period ...time.Duration) {
-	p := time.Second * 5
-	if len(period) > 0 && period[0] > 0 {
-		p = period[0]
+	period ...time.Duration) error {
+	return newRetryer(numberOfRetries, onError, period).do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryStats works like Retry, but returns the stats of the run,
+// whether it succeeded or not.
+func RetryStats(
+	f func() error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) Stats {
+	return newRetryer(numberOfRetries, onError, period).run(context.Background(), ignoreAttempt(f))
+}
+
+// RetryNotify works like Retry, but calls notify after each failed
+// attempt, with its error, its number, starting at 1, and the period
+// to sleep before the next attempt; which is 0 after the last attempt.
+func RetryNotify(
+	f func() error,
+	numberOfRetries int,
+	notify func(err error, attempt int, next time.Duration),
+	period ...time.Duration) error {
+	r := newRetryer(numberOfRetries, nil, period)
+	r.notify = notify
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryN works like Retry, but passes the number of the current attempt
+// to f, starting at 1.
+func RetryN(
+	f func(attempt int) error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) error {
+	return newRetryer(numberOfRetries, onError, period).do(context.Background(), withAttempt(f))
+}
+
+// RetryResult works like Retry, for a function that returns a value.
+// It returns the value of the successful attempt, or the zero value
+// and the error of the last attempt.
+func RetryResult[T any](
+	f func() (T, error),
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) (T, error) {
+	var res T
+	err := Retry(func() error {
+		v, err := f()
+		if err != nil {
+			return err
+		}
+		res = v
+		return nil
+	}, numberOfRetries, onError, period...)
+	if err != nil {
+		var zero T
+		return zero, err
 	}
-	for numberOfRetries != 0 {
-		if numberOfRetries > 0 {
-			numberOfRetries--
+	return res, nil
+}
+
+// RetryResultStats works like RetryResult, but also returns the stats
+// of the run. It returns the zero value if no attempt succeeded.
+func RetryResultStats[T any](
+	f func() (T, error),
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) (T, Stats) {
+	var res T
+	st := RetryStats(func() error {
+		v, err := f()
+		if err != nil {
+			return err
+		}
+		res = v
+		return nil
+	}, numberOfRetries, onError, period...)
+	if st.LastErr != nil {
+		var zero T
+		return zero, st
+	}
+	return res, st
+}
+
+// RetryContext works like Retry, but stops as soon as ctx is done,
+// including while sleeping between two attempts, and returns ctx.Err().
+// If the deadline of ctx would pass before the next attempt, it does not
+// sleep, and gives up immediately, with the error of the last attempt.
+// An attempt failing with context.Canceled, or with
+// context.DeadlineExceeded once ctx is done, stops retrying immediately,
+// and that error is returned. Otherwise it returns the error of the last attempt, or nil if
+// an attempt succeeded. ctx is passed to f, so it can abort its own work.
+func RetryContext(
+	ctx context.Context,
+	f func(ctx context.Context) error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) error {
+	return newRetryer(numberOfRetries, onError, period).do(ctx, withContext(f))
+}
+
+// RetryResultContext works like RetryContext, for a function that returns
+// a value. It returns the value of the successful attempt; or the zero
+// value, and ctx.Err() if ctx is done, including while sleeping between
+// two attempts, or the error of the last attempt.
+func RetryResultContext[T any](
+	ctx context.Context,
+	f func(ctx context.Context) (T, error),
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) (T, error) {
+	var res T
+	err := RetryContext(ctx, func(ctx context.Context) error {
+		v, err := f(ctx)
+		if err != nil {
+			return err
 		}
-		if err := Try(f); err != nil {
-			if onError != nil {
+		res = v
+		return nil
+	}, numberOfRetries, onError, period...)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return res, nil
+}
+
+// RetryCtx works like RetryContext, but retries as long as there are any
+// errors, until ctx is done; so the deadline of ctx, if it has one, is
+// the time budget of the whole retrying. Sleeping is interrupted once ctx
+// is done; and if the deadline would pass before the next attempt, it
+// returns the error of the last attempt without sleeping. If ctx has no
+// deadline, and is never canceled, it retries forever, like Retry with
+// numberOfRetries < 0.
+func RetryCtx(
+	ctx context.Context,
+	f func(ctx context.Context) error,
+	onError func(error),
+	period ...time.Duration) error {
+	return RetryContext(ctx, f, -1, onError, period...)
+}
+
+// RetryTimes is the same as Retry; it runs f at most maxAttempts times
+// in total. One initial try plus 3 retries is RetryTimes(f, 4, ...).
+func RetryTimes(
+	f func() error,
+	maxAttempts int,
+	onError func(error),
+	period ...time.Duration) error {
+	return Retry(f, maxAttempts, onError, period...)
+}
+
+// RetryForever runs Retry(f, -1, onError, period...) in a goroutine,
+// and returns a function to stop it, after the current attempt, or
+// while sleeping. Calling stop more than once, or from other goroutines,
+// is safe.
+func RetryForever(
+	f func() error,
+	onError func(error),
+	period ...time.Duration) (stop func()) {
+	var once sync.Once
+	stopped := make(chan struct{})
+	r := newRetryer(-1, onError, period)
+	r.stop = stopped
+	go r.do(context.Background(), ignoreAttempt(f))
+	return func() { once.Do(func() { close(stopped) }) }
+}
+
+// RetryWithin retries running a function, as long as there are any errors,
+// until d has passed since the first attempt. The last sleep is shortened
+// so it does not go past d. It returns nil if an attempt succeeded;
+// otherwise the error of the last attempt, wrapped in a TimeoutError.
+// If d <= 0, f is run once.
+func RetryWithin(
+	d time.Duration,
+	f func() error,
+	onError func(error),
+	period ...time.Duration) error {
+	r := newRetryer(-1, onError, period)
+	if d <= 0 {
+		r.until = time.Now()
+	} else {
+		r.maxElapsedTime = d
+	}
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryBackoff works like Retry, but the period between two attempts
+// is computed by b. If b is nil, the default period is used.
+func RetryBackoff(
+	f func() error,
+	numberOfRetries int,
+	onError func(error),
+	b Backoff) error {
+	r := newRetryer(numberOfRetries, onError, nil)
+	if b != nil {
+		r.backoff = b
+	}
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryAny works like Retry, but each attempt runs the next function of
+// fns, in order, starting over after the last one; so it returns nil as
+// soon as one of them succeeds. Otherwise it returns the errors of all
+// attempts, joined by errors.Join. If fns is empty, nothing is run
+// and nil is returned.
+func RetryAny(
+	fns []func() error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) error {
+	if len(fns) == 0 {
+		return nil
+	}
+	r := newRetryer(numberOfRetries, onError, period)
+	r.joinErrors = true
+	return r.do(context.Background(), withAttempt(func(attempt int) error {
+		return fns[(attempt-1)%len(fns)]()
+	}))
+}
+
+// RetryAsync runs Retry(f, numberOfRetries, onError, period...) in
+// a goroutine, and sends its error, or nil, on the returned channel,
+// then closes it. A panic in onError is recovered too, and sent as
+// the error. The channel is buffered, so the goroutine does not leak
+// if nobody receives from it.
+func RetryAsync(
+	f func() error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer close(done)
+		done <- Try(func() error {
+			return Retry(f, numberOfRetries, onError, period...)
+		})
+	}()
+	return done
+}
+
+// RetryBatch runs Retry for each function of fns, at most concurrency
+// of them at the same time, and returns their errors, in the same order
+// as fns. If concurrency <= 0, all of them run at the same time.
+// A panic in one of them does not stop the others; see RetryAsync.
+func RetryBatch(
+	fns []func() error,
+	concurrency int,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) []error {
+	if concurrency <= 0 || concurrency > len(fns) {
+		concurrency = len(fns)
+	}
+	errs := make([]error, len(fns))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, f := range fns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, f func() error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = <-RetryAsync(f, numberOfRetries, onError, period...)
+		}(i, f)
+	}
+	wg.Wait()
+	return errs
+}
+
+// RetryPeriodFunc works like Retry, but the period to sleep after each
+// failed attempt is computed by period, from the number of the attempt
+// and its error. If period is nil, the default period is used.
+func RetryPeriodFunc(
+	f func() error,
+	numberOfRetries int,
+	onError func(error),
+	period PeriodFunc) error {
+	r := newRetryer(numberOfRetries, onError, nil)
+	r.periodFunc = period
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryOK works like Retry, but only reports whether an attempt
+// succeeded. If numberOfRetries == 0, f is never run, and it
+// returns false.
+func RetryOK(
+	f func() error,
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) bool {
+	st := RetryStats(f, numberOfRetries, onError, period...)
+	return st.Attempts > 0 && st.LastErr == nil
+}
+
+// RetryUntil works like Retry, but onError decides, for each failed
+// attempt, whether to stop retrying; if it returns true, RetryUntil
+// returns that error immediately, without sleeping. If onError is nil,
+// it works like Retry.
+func RetryUntil(
+	f func() error,
+	numberOfRetries int,
+	onError func(err error) (stop bool),
+	period ...time.Duration) error {
+	r := newRetryer(numberOfRetries, nil, period)
+	r.onErrorStop = onError
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryIf works like Retry, but only retries the errors for which
+// shouldRetry returns true; for any other error, it returns immediately,
+// without sleeping, and without any more attempts. onError is still
+// called with that error. If shouldRetry is nil, it works like Retry.
+func RetryIf(
+	f func() error,
+	numberOfRetries int,
+	shouldRetry func(error) bool,
+	onError func(error),
+	period ...time.Duration) error {
+	r := newRetryer(numberOfRetries, onError, period)
+	r.retryIf = shouldRetry
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryUntilTime works like RetryWithin, but retries until deadline.
+// If deadline has already passed, f is run once. The After of
+// the TimeoutError it returns is the time spent retrying.
+func RetryUntilTime(
+	deadline time.Time,
+	f func() error,
+	onError func(error),
+	period ...time.Duration) error {
+	r := newRetryer(-1, onError, period)
+	r.until = deadline
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// RetryContextNotify works like RetryContext, but calls notify after each
+// failed attempt, with ctx, so it can use its values, like a request ID;
+// and the error and the number of the attempt, starting at 1.
+func RetryContextNotify(
+	ctx context.Context,
+	f func(ctx context.Context) error,
+	numberOfRetries int,
+	notify func(ctx context.Context, err error, attempt int),
+	period ...time.Duration) error {
+	r := newRetryer(numberOfRetries, nil, period)
+	if notify != nil {
+		r.notify = func(err error, attempt int, _ time.Duration) { notify(ctx, err, attempt) }
+	}
+	return r.do(ctx, withContext(f))
+}
+
+// RetryPoll calls f, numberOfRetries times, sleeping between two calls,
+// until it reports it is done, like polling for a resource to be ready.
+// Not being done yet is not an error. If f returns an error, or panics,
+// it stops immediately, calls onError with it, and returns it. It returns
+// ErrNotDone if f was not done after the last call.
+func RetryPoll(
+	f func() (done bool, err error),
+	numberOfRetries int,
+	onError func(error),
+	period ...time.Duration) error {
+	r := newRetryer(numberOfRetries, nil, period)
+	if onError != nil {
+		r.onError = func(err error) {
+			if err != ErrNotDone {
 				onError(err)
 			}
-			if numberOfRetries != 0 {
-				time.Sleep(p)
-			}
-		} else {
-			break
 		}
 	}
+	return r.do(context.Background(), ignoreAttempt(func() error {
+		done, err := TryResult(f)
+		if err != nil {
+			return Permanent(err)
+		}
+		if !done {
+			return ErrNotDone
+		}
+		return nil
+	}))
 }
@@ -3,6 +3,10 @@ package retry
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -59,6 +63,47 @@ func TestOnError(t *testing.T) {
 	assert.Equal(t, int64(6), sum)
 }
 
+func TestOnErrorStats(t *testing.T) {
+	st := RetryStats(func() error {
+		panic("X")
+	},
+		3,
+		nil,
+		time.Millisecond)
+	assert.Equal(t, 3, st.Attempts)
+	assert.Equal(t, 3, st.Failures)
+
+	var sum int64
+	st = RetryStats(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	},
+		5,
+		nil,
+		time.Millisecond)
+	assert.Equal(t, 3, st.Attempts)
+	assert.Equal(t, 2, st.Failures)
+}
+
+func TestOnErrorCancelDuringSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sum int64
+	start := time.Now()
+	err := RetryContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		panic("X")
+	},
+		3,
+		func(error) { cancel() },
+		time.Minute)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(1), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+}
+
 func TestOnError2(t *testing.T) {
 	var sum int64
 	Retry(func() error {
@@ -90,6 +135,870 @@ func TestOnError3(t *testing.T) {
 	assert.Equal(t, int64(1), sum)
 }
 
+func TestRetryLastError(t *testing.T) {
+	var sum int64
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY %d", atomic.LoadInt64(&sum))
+	},
+		3,
+		nil,
+		time.Millisecond*10)
+	assert.EqualError(t, err, "DUMMY 3")
+}
+
+func TestRetryLastErrorPanic(t *testing.T) {
+	err := Retry(func() error {
+		panic("X")
+	},
+		2,
+		nil,
+		time.Millisecond*10)
+	assert.Equal(t, "X", err.(interface{ CausedBy() interface{} }).CausedBy())
+}
+
+func TestRetryEventualSuccess(t *testing.T) {
+	var sum int64
+	err := Retry(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	},
+		5,
+		nil,
+		time.Millisecond*10)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestSetDefaultPeriod(t *testing.T) {
+	defer SetDefaultPeriod(0)
+	assert.Equal(t, time.Second*5, DefaultPeriod())
+
+	SetDefaultPeriod(time.Millisecond * 20)
+	assert.Equal(t, time.Millisecond*20, DefaultPeriod())
+	var nexts []time.Duration
+	RetryNotify(func() error {
+		return errors.Errorf("DUMMY")
+	},
+		2,
+		func(err error, attempt int, next time.Duration) { nexts = append(nexts, next) })
+	assert.Equal(t, []time.Duration{time.Millisecond * 20, 0}, nexts)
+
+	nexts = nil
+	RetryNotify(func() error {
+		return errors.Errorf("DUMMY")
+	},
+		2,
+		func(err error, attempt int, next time.Duration) { nexts = append(nexts, next) },
+		time.Millisecond*10)
+	assert.Equal(t, []time.Duration{time.Millisecond * 10, 0}, nexts)
+
+	assert.Equal(t, time.Millisecond*20, mustRetryer().backoff.NextBackOff(1))
+	assert.Equal(t, time.Millisecond*20, (&ExponentialBackoff{}).NextBackOff(1))
+
+	SetDefaultPeriod(0)
+	assert.Equal(t, time.Second*5, DefaultPeriod())
+}
+
+func TestRetryTimes(t *testing.T) {
+	var sum int64
+	RetryTimes(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	},
+		4,
+		nil,
+		time.Millisecond*10)
+	assert.Equal(t, int64(4), sum)
+}
+
+func TestRetryForever(t *testing.T) {
+	var sum int64
+	stop := RetryForever(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	},
+		nil,
+		time.Millisecond*10)
+	time.Sleep(time.Millisecond * 55)
+	stop()
+	n := atomic.LoadInt64(&sum)
+	assert.True(t, n >= 3 && n <= 7, n)
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, n, atomic.LoadInt64(&sum))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() { defer wg.Done(); stop() }()
+	}
+	wg.Wait()
+}
+
+func TestRetryForeverSuccess(t *testing.T) {
+	done := make(chan struct{})
+	var sum int64
+	stop := RetryForever(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errors.Errorf("DUMMY")
+		}
+		close(done)
+		return nil
+	},
+		nil,
+		time.Millisecond*10)
+	defer stop()
+	<-done
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&sum))
+}
+
+func TestRetryStats(t *testing.T) {
+	st := RetryStats(func() error {
+		return errors.Errorf("DUMMY")
+	},
+		3,
+		nil,
+		time.Millisecond*20)
+	assert.Equal(t, 3, st.Attempts)
+	assert.EqualError(t, st.LastErr, "DUMMY")
+	assert.True(t, st.Elapsed >= time.Millisecond*40, st.Elapsed)
+}
+
+func TestRetryStatsSuccess(t *testing.T) {
+	var sum int64
+	st := RetryStats(func() error {
+		if atomic.AddInt64(&sum, 1) < 2 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	},
+		5,
+		nil,
+		time.Millisecond*20)
+	assert.Equal(t, 2, st.Attempts)
+	assert.NoError(t, st.LastErr)
+	assert.True(t, st.Elapsed >= time.Millisecond*20, st.Elapsed)
+	assert.True(t, st.Elapsed < time.Millisecond*40, st.Elapsed)
+}
+
+func TestRetryNotify(t *testing.T) {
+	var (
+		attempts []int
+		nexts    []time.Duration
+	)
+	err := RetryNotify(func() error {
+		return errors.Errorf("DUMMY")
+	},
+		3,
+		func(err error, attempt int, next time.Duration) {
+			assert.EqualError(t, err, "DUMMY")
+			attempts = append(attempts, attempt)
+			nexts = append(nexts, next)
+		},
+		time.Millisecond*10)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	assert.Equal(t, []time.Duration{time.Millisecond * 10, time.Millisecond * 10, 0}, nexts)
+}
+
+func TestRetryN(t *testing.T) {
+	var attempts []int
+	err := RetryN(func(attempt int) error {
+		attempts = append(attempts, attempt)
+		if attempt < 3 {
+			panic("X")
+		}
+		return nil
+	},
+		5,
+		nil,
+		time.Millisecond*10)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+}
+
+func TestRetryResult(t *testing.T) {
+	var sum int64
+	v, err := RetryResult(func() (int, error) {
+		n := atomic.AddInt64(&sum, 1)
+		if n < 3 {
+			return -1, errors.Errorf("DUMMY")
+		}
+		return int(n) * 10, nil
+	},
+		5,
+		nil,
+		time.Millisecond*10)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, v)
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryResultError(t *testing.T) {
+	v, err := RetryResult(func() (string, error) {
+		return "partial", errors.Errorf("DUMMY")
+	},
+		3,
+		nil,
+		time.Millisecond*10)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, "", v)
+}
+
+func TestRetryResultPanic(t *testing.T) {
+	var sum int64
+	v, err := RetryResult(func() (*int64, error) {
+		if atomic.AddInt64(&sum, 1) < 2 {
+			panic("X")
+		}
+		return &sum, nil
+	},
+		3,
+		nil,
+		time.Millisecond*10)
+	assert.NoError(t, err)
+	assert.Equal(t, &sum, v)
+}
+
+func TestTryResult(t *testing.T) {
+	v, err := TryResult(func() (int, error) { return 1, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	v, err = TryResult(func() (int, error) { return 2, errors.Errorf("DUMMY") })
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, 2, v)
+}
+
+func TestTryResultPanic(t *testing.T) {
+	v, err := TryResult(func() (int, error) {
+		panic("X")
+	})
+	assert.Equal(t, 0, v)
+	assert.IsType(t, &PanicError{}, err)
+	assert.Equal(t, "X", err.(*PanicError).CausedBy())
+}
+
+func TestRetryContextCancelDuringSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var sum int64
+	startedAt := time.Now()
+	err := RetryContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	},
+		3,
+		func(error) { cancel() },
+		time.Second*10)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(1), sum)
+	assert.True(t, time.Since(startedAt) < time.Second)
+}
+
+func TestRetryContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*120)
+	defer cancel()
+	var sum int64
+	err := RetryContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	},
+		-1,
+		nil,
+		time.Millisecond*50)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryContextPassesContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var sum int64
+	err := RetryContext(ctx, func(ctx context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	},
+		3,
+		nil,
+		time.Second*10)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var sum int64
+	err := RetryContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	},
+		3,
+		nil,
+		time.Millisecond*50)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(0), sum)
+}
+
+func TestRetryContextLastError(t *testing.T) {
+	var sum int64
+	err := RetryContext(context.Background(), func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY %d", atomic.LoadInt64(&sum))
+	},
+		3,
+		nil,
+		time.Millisecond*10)
+	assert.EqualError(t, err, "DUMMY 3")
+
+	err = RetryContext(context.Background(), func(context.Context) error { return nil }, 3, nil)
+	assert.NoError(t, err)
+}
+
+func TestRetryAny(t *testing.T) {
+	var calls []string
+	mirror := func(name string, err error) func() error {
+		return func() error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+	err := RetryAny([]func() error{
+		mirror("a", errors.New("A DOWN")),
+		mirror("b", errors.New("B DOWN")),
+		mirror("c", nil),
+	}, 5, nil, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, calls)
+}
+
+func TestRetryAnyRotates(t *testing.T) {
+	var calls []string
+	errA, errB := errors.New("A DOWN"), errors.New("B DOWN")
+	err := RetryAny([]func() error{
+		func() error { calls = append(calls, "a"); return errA },
+		func() error { calls = append(calls, "b"); return errB },
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, []string{"a", "b", "a"}, calls)
+	assert.True(t, errors.Is(err, errA))
+	assert.True(t, errors.Is(err, errB))
+	assert.EqualError(t, err, "A DOWN\nB DOWN\nA DOWN")
+}
+
+func TestRetryAnyEmpty(t *testing.T) {
+	assert.NoError(t, RetryAny(nil, 3, nil))
+}
+
+func TestRetryAsync(t *testing.T) {
+	var sum int64
+	done := RetryAsync(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	}, 5, nil, time.Millisecond)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&sum))
+	_, open := <-done
+	assert.False(t, open)
+
+	done = RetryAsync(func() error { return errors.Errorf("DUMMY") }, 2, nil, time.Millisecond)
+	assert.EqualError(t, <-done, "DUMMY")
+}
+
+func TestRetryAsyncPanic(t *testing.T) {
+	done := RetryAsync(func() error {
+		return errors.Errorf("DUMMY")
+	}, 2, func(error) { panic("ONERROR") }, time.Millisecond)
+	err := <-done
+	assert.True(t, IsPanic(err))
+}
+
+func TestRetryBatch(t *testing.T) {
+	var running, maxRunning int64
+	fns := make([]func() error, 10)
+	for i := range fns {
+		i := i
+		fns[i] = func() error {
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				m := atomic.LoadInt64(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 5)
+			switch i {
+			case 3:
+				panic("DUMMY PANIC")
+			case 7:
+				return errors.Errorf("DUMMY %d", i)
+			}
+			return nil
+		}
+	}
+	errs := RetryBatch(fns, 3, 2, nil, time.Millisecond)
+	assert.Equal(t, len(fns), len(errs))
+	assert.True(t, atomic.LoadInt64(&maxRunning) <= 3)
+	for i, err := range errs {
+		switch i {
+		case 3:
+			assert.True(t, IsPanic(err))
+		case 7:
+			assert.EqualError(t, err, "DUMMY 7")
+		default:
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestRetryBatchEmpty(t *testing.T) {
+	assert.Equal(t, 0, len(RetryBatch(nil, 3, 2, nil)))
+}
+
+func TestRetryPeriodFunc(t *testing.T) {
+	var attempts []int
+	start := time.Now()
+	err := RetryPeriodFunc(func() error {
+		return errors.Errorf("DUMMY")
+	}, 3, nil, func(attempt int, lastErr error) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond * 10
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, []int{1, 2}, attempts)
+	assert.True(t, time.Since(start) >= time.Millisecond*20)
+}
+
+func TestRetryOK(t *testing.T) {
+	var sum int64
+	ok := RetryOK(func() error {
+		if atomic.AddInt64(&sum, 1) < 2 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	}, 3, nil, time.Millisecond)
+	assert.True(t, ok)
+
+	assert.False(t, RetryOK(func() error { return errors.Errorf("DUMMY") }, 2, nil, time.Millisecond))
+	assert.False(t, RetryOK(func() error { panic("X") }, 1, nil))
+	assert.False(t, RetryOK(func() error { return nil }, 0, nil))
+}
+
+func TestRetryUntil(t *testing.T) {
+	var sum int64
+	var seen []string
+	start := time.Now()
+	err := RetryUntil(func() error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	}, 10, func(err error) bool {
+		seen = append(seen, err.Error())
+		return len(seen) == 3
+	}, time.Millisecond*20)
+	assert.EqualError(t, err, "DUMMY 3")
+	assert.Equal(t, []string{"DUMMY 1", "DUMMY 2", "DUMMY 3"}, seen)
+	assert.True(t, time.Since(start) < time.Millisecond*60)
+
+	sum = 0
+	err = RetryUntil(func() error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	}, 3, nil, time.Millisecond)
+	assert.EqualError(t, err, "DUMMY 3")
+}
+
+func TestRetryUntilTime(t *testing.T) {
+	var sum int64
+	start := time.Now()
+	err := RetryUntilTime(start.Add(time.Millisecond*100), func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, nil, time.Millisecond*60)
+	elapsed := time.Since(start)
+	var te TimeoutError
+	assert.True(t, errors.As(err, &te))
+	assert.True(t, te.Overall)
+	assert.EqualError(t, te.Err, "DUMMY")
+	assert.True(t, te.After > time.Millisecond*90 && te.After <= elapsed, te.After)
+	assert.True(t, strings.HasSuffix(err.Error(), ": DUMMY"), err)
+	// 0ms, 60ms, and a final one at 100ms.
+	assert.Equal(t, int64(3), sum)
+	assert.InDelta(t, float64(time.Millisecond*100), float64(elapsed), float64(time.Millisecond*20))
+}
+
+func TestRetryUntilTimePast(t *testing.T) {
+	var sum int64
+	err := RetryUntilTime(time.Now().Add(-time.Second), func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, nil, time.Millisecond)
+	var te TimeoutError
+	assert.True(t, errors.As(err, &te))
+	assert.True(t, te.Overall)
+	assert.EqualError(t, te.Err, "DUMMY")
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestTryContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "REQ-1")
+	err := TryContext(ctx, func(ctx context.Context) error {
+		return errors.Errorf("%v", ctx.Value(requestIDKey{}))
+	})
+	assert.EqualError(t, err, "REQ-1")
+
+	err = TryContext(ctx, func(context.Context) error { panic("X") })
+	assert.True(t, IsPanic(err))
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	var ran bool
+	err = TryContext(cctx, func(context.Context) error {
+		ran = true
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, ran)
+}
+
+func TestTryWithTimeout(t *testing.T) {
+	err := TryWithTimeout(func() error { return nil }, time.Second)
+	assert.NoError(t, err)
+
+	err = TryWithTimeout(func() error { return errors.Errorf("DUMMY") }, time.Second)
+	assert.EqualError(t, err, "DUMMY")
+
+	err = TryWithTimeout(func() error { panic("X") }, time.Second)
+	assert.True(t, IsPanic(err))
+
+	release := make(chan struct{})
+	defer close(release)
+	start := time.Now()
+	err = TryWithTimeout(func() error {
+		<-release
+		return nil
+	}, time.Millisecond*20)
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, time.Since(start) < time.Millisecond*200)
+
+	err = TryWithTimeout(func() error { return errors.Errorf("DUMMY") }, 0)
+	assert.EqualError(t, err, "DUMMY")
+}
+
+func TestRetryPanicPanicSuccess(t *testing.T) {
+	var sum int64
+	var errs []error
+	err := Retry(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			panic("X")
+		}
+		return nil
+	}, 5, func(err error) { errs = append(errs, err) }, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), sum)
+	assert.Equal(t, 2, len(errs))
+	for _, err := range errs {
+		assert.True(t, IsPanic(err))
+	}
+}
+
+type requestIDKey struct{}
+
+func TestRetryContextNotify(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "REQ-1")
+	var seen []string
+	var sum int64
+	err := RetryContextNotify(ctx, func(context.Context) error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	}, 3, func(ctx context.Context, err error, attempt int) {
+		seen = append(seen, fmt.Sprintf("%v %d %v", ctx.Value(requestIDKey{}), attempt, err))
+	}, time.Millisecond)
+	assert.EqualError(t, err, "DUMMY 3")
+	assert.Equal(t, []string{"REQ-1 1 DUMMY 1", "REQ-1 2 DUMMY 2", "REQ-1 3 DUMMY 3"}, seen)
+
+	err = RetryContextNotify(ctx, func(context.Context) error { return errors.Errorf("DUMMY") }, 1, nil)
+	assert.EqualError(t, err, "DUMMY")
+}
+
+func TestRetryZeroPeriod(t *testing.T) {
+	var sum int64
+	start := time.Now()
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, 100, nil, 0)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(100), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+
+	sum = 0
+	start = time.Now()
+	RetryN(func(int) error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, 10, nil, -time.Second)
+	assert.Equal(t, int64(10), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+}
+
+func TestRetryResultStats(t *testing.T) {
+	var sum int64
+	v, st := RetryResultStats(func() (int64, error) {
+		n := atomic.AddInt64(&sum, 1)
+		if n < 3 {
+			return n, errors.Errorf("DUMMY")
+		}
+		return n * 10, nil
+	}, 5, nil, time.Millisecond)
+	assert.Equal(t, int64(30), v)
+	assert.Equal(t, 3, st.Attempts)
+	assert.Equal(t, 2, st.Failures)
+	assert.NoError(t, st.LastErr)
+	assert.True(t, st.Elapsed >= time.Millisecond*2)
+
+	s, st := RetryResultStats(func() (string, error) {
+		return "PARTIAL", errors.Errorf("DUMMY")
+	}, 2, nil, time.Millisecond)
+	assert.Equal(t, "", s)
+	assert.Equal(t, 2, st.Attempts)
+	assert.EqualError(t, st.LastErr, "DUMMY")
+	assert.Equal(t, Failed, st.Outcome)
+}
+
+func TestRetryPoll(t *testing.T) {
+	var sum int64
+	var errs []error
+	onError := func(err error) { errs = append(errs, err) }
+	err := RetryPoll(func() (bool, error) {
+		return atomic.AddInt64(&sum, 1) == 3, nil
+	}, 5, onError, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), sum)
+	assert.Equal(t, 0, len(errs))
+
+	err = RetryPoll(func() (bool, error) { return false, nil }, 3, onError, time.Millisecond)
+	assert.Equal(t, ErrNotDone, err)
+	assert.Equal(t, 0, len(errs))
+
+	sum = 0
+	err = RetryPoll(func() (bool, error) {
+		if atomic.AddInt64(&sum, 1) == 2 {
+			return false, errors.Errorf("DUMMY")
+		}
+		return false, nil
+	}, 5, onError, time.Millisecond)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(2), sum)
+	assert.Equal(t, 1, len(errs))
+
+	sum = 0
+	err = RetryPoll(func() (bool, error) {
+		atomic.AddInt64(&sum, 1)
+		panic("X")
+	}, 5, nil, time.Millisecond)
+	assert.True(t, IsPanic(err))
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestSetPanicClassifier(t *testing.T) {
+	errTransient := errors.New("TRANSIENT")
+	SetPanicClassifier(func(recovered interface{}) bool {
+		err, ok := recovered.(error)
+		return ok && errors.Is(err, errTransient)
+	})
+	defer SetPanicClassifier(nil)
+
+	var calls int
+	err := Retry(func() error {
+		calls++
+		panic("BUG")
+	}, 5, nil, time.Millisecond)
+	assert.Equal(t, 1, calls)
+	assert.True(t, IsPanic(err))
+
+	calls = 0
+	err = Retry(func() error {
+		calls++
+		panic(errTransient)
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, 3, calls)
+	assert.True(t, errors.Is(err, errTransient))
+
+	calls = 0
+	Retry(func() error {
+		calls++
+		return errors.New("DUMMY")
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, 3, calls)
+
+	SetPanicClassifier(nil)
+	calls = 0
+	Retry(func() error {
+		calls++
+		panic("BUG")
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryResultContext(t *testing.T) {
+	var calls int
+	v, err := RetryResultContext(context.Background(), func(context.Context) (string, error) {
+		if calls++; calls < 3 {
+			return "PARTIAL", errors.Errorf("DUMMY")
+		}
+		return "OK", nil
+	}, 5, nil, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", v)
+	assert.Equal(t, 3, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	startedAt := time.Now()
+	v, err = RetryResultContext(ctx, func(context.Context) (string, error) {
+		calls++
+		return "PARTIAL", errors.Errorf("DUMMY")
+	}, 5, func(error) {
+		go func() {
+			time.Sleep(time.Millisecond * 20)
+			cancel()
+		}()
+	}, time.Second)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "", v)
+	assert.Equal(t, 1, calls)
+	assert.True(t, time.Since(startedAt) < time.Millisecond*500)
+}
+
+func TestRetryCtx(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var calls int
+	startedAt := time.Now()
+	err := RetryCtx(ctx, func(context.Context) error {
+		calls++
+		return errors.Errorf("DUMMY")
+	}, nil, time.Millisecond*30)
+	assert.EqualError(t, err, "DUMMY")
+	assert.True(t, time.Since(startedAt) < time.Millisecond*100)
+	assert.True(t, calls >= 3 && calls <= 4)
+
+	calls = 0
+	err = RetryCtx(context.Background(), func(context.Context) error {
+		if calls++; calls < 5 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	}, nil, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, calls)
+}
+
+func TestRetryIf(t *testing.T) {
+	errFatal := errors.New("FATAL")
+	var calls, errs int
+	startedAt := time.Now()
+	err := RetryIf(func() error {
+		calls++
+		return errFatal
+	}, 5, func(err error) bool { return err != errFatal },
+		func(error) { errs++ },
+		time.Second*30)
+	assert.Equal(t, errFatal, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, errs)
+	assert.True(t, time.Since(startedAt) < time.Millisecond*10)
+
+	calls = 0
+	err = RetryIf(func() error {
+		if calls++; calls < 3 {
+			return errors.New("DUMMY")
+		}
+		return errFatal
+	}, 5, func(err error) bool { return err != errFatal }, nil, time.Millisecond)
+	assert.Equal(t, errFatal, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	RetryIf(func() error {
+		calls++
+		return errFatal
+	}, 3, nil, nil, time.Millisecond)
+	assert.Equal(t, 3, calls)
+}
+
+func TestSetRandomizationFactor(t *testing.T) {
+	assert.Equal(t, 0.0, RandomizationFactor())
+	SetRandomizationFactor(0.5)
+	defer SetRandomizationFactor(0)
+	assert.Equal(t, 0.5, RandomizationFactor())
+
+	var last time.Time
+	var gaps []time.Duration
+	Retry(func() error {
+		if now := time.Now(); !last.IsZero() {
+			gaps = append(gaps, now.Sub(last))
+		}
+		last = time.Now()
+		return errors.Errorf("DUMMY")
+	}, 11, nil, time.Millisecond*20)
+	varied := false
+	for _, g := range gaps {
+		assert.True(t, g >= time.Millisecond*10 && g < time.Millisecond*40, g)
+		varied = varied || g < time.Millisecond*18 || g > time.Millisecond*25
+	}
+	assert.True(t, varied)
+
+	s := &fakeSleeper{}
+	mustRetryer(WithMaxAttempts(3), WithPeriod(time.Second), WithRandomizationFactor(0), WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, s.delays)
+
+	SetRandomizationFactor(2)
+	assert.Equal(t, 1.0, RandomizationFactor())
+	SetRandomizationFactor(math.NaN())
+	assert.Equal(t, 0.0, RandomizationFactor())
+}
+
+func TestSetRandomizationFactorNotStacked(t *testing.T) {
+	SetRandomizationFactor(0.5)
+	defer SetRandomizationFactor(0)
+	period := time.Millisecond * 100
+	delays := func(opts ...Option) []time.Duration {
+		s := &fakeSleeper{}
+		opts = append(opts, WithMaxAttempts(200), WithRand(rand.New(rand.NewSource(1))), WithSleeper(s))
+		mustRetryer(opts...).Do(func() error { return errors.Errorf("DUMMY") })
+		return s.delays
+	}
+	within := func(ds []time.Duration) bool {
+		for _, d := range ds {
+			if d < period/2 || d > period*3/2 {
+				return false
+			}
+		}
+		return true
+	}
+
+	r, err := NewRetryerFromPolicy(Policy{MaxAttempts: 200, Period: period, Jitter: 0.5},
+		WithRand(rand.New(rand.NewSource(1))), WithSleeper(&fakeSleeper{}))
+	assert.NoError(t, err)
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.True(t, within(r.sleeper.(*fakeSleeper).delays))
+
+	assert.True(t, within(delays(WithBackoff(&ExponentialBackoff{
+		Period:              period,
+		RandomizationFactor: 0.5,
+		Rand:                rand.New(rand.NewSource(1)),
+	}))))
+	assert.True(t, within(delays(WithPeriod(period))))
+	assert.True(t, within(delays(WithPeriod(period), WithRandomizationFactor(0.5))))
+	assert.NotEqual(t, period, delays(WithPeriod(period))[0])
+}
+
 func ExampleTry() {
 	Try(func() error {
 		fmt.Println("done")
@@ -111,6 +1020,16 @@ func ExampleTry_error() {
 	// FAILED
 }
 
+func ExampleTryResult() {
+	v, err := TryResult(func() (int, error) {
+		return 42, nil
+	})
+	fmt.Println(v, err)
+
+	// Output:
+	// 42 <nil>
+}
+
 func ExampleRetry() {
 	Retry(func() error {
 		fmt.Println(1)
@@ -155,6 +1074,66 @@ func ExampleRetry_panic() {
 	// FAILED
 }
 
+func ExampleRetry_lastError() {
+	err := Retry(func() error {
+		return errors.Errorf("FAILED")
+	},
+		3, nil,
+		time.Millisecond*50)
+	fmt.Println(err)
+
+	// Output:
+	// FAILED
+}
+
+func ExampleRetryNotify() {
+	RetryNotify(func() error {
+		return errors.Errorf("FAILED")
+	},
+		3, func(err error, attempt int, next time.Duration) {
+			fmt.Println(attempt, err, next)
+		},
+		time.Millisecond*50)
+
+	// Output:
+	// 1 FAILED 50ms
+	// 2 FAILED 50ms
+	// 3 FAILED 0s
+}
+
+func ExampleRetryN() {
+	RetryN(func(attempt int) error {
+		if attempt > 1 {
+			fmt.Println("retrying", attempt)
+		}
+		return errors.Errorf("FAILED")
+	},
+		3, nil,
+		time.Millisecond*50)
+
+	// Output:
+	// retrying 2
+	// retrying 3
+}
+
+func ExampleRetryResult() {
+	var cnt int64
+	v, err := RetryResult(func() (string, error) {
+		if atomic.AddInt64(&cnt, 1) < 3 {
+			return "", errors.Errorf("FAILED")
+		}
+		return "done", nil
+	},
+		3, func(err error) { fmt.Println(err) },
+		time.Millisecond*50)
+	fmt.Println(v, err)
+
+	// Output:
+	// FAILED
+	// FAILED
+	// done <nil>
+}
+
 func ExampleRetry_period() {
 	startedAt := time.Now()
 	Retry(func() error {
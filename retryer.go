@@ -0,0 +1,1230 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Retryer holds a retry policy, to be reused across many calls.
+// Use NewRetryer to create one.
+//
+// A Retryer is safe for concurrent use by many goroutines; the state of
+// each call is kept local to it, including a DecorrelatedJitterBackoff,
+// which each call gets a copy of. The state shared by all calls, like
+// the circuit breaker of WithCircuitBreaker, is guarded by a mutex; and so
+// is the backoff. A custom Backoff that keeps state is shared by
+// the concurrent calls though, and each of them starts it over; so use
+// one Retryer per goroutine for it.
+type Retryer struct {
+	maxAttempts        int
+	maxElapsedTime     time.Duration
+	until              time.Time
+	defaultPeriod      time.Duration
+	backoffMu          sync.Mutex
+	backoff            Backoff
+	periodFunc         PeriodFunc
+	maxInterval        time.Duration
+	randomization      float64
+	hasRandomization   bool
+	multiplier         float64
+	resetAfter         time.Duration
+	delayHook          func(attempt int, planned time.Duration) time.Duration
+	estimatedAttempt   time.Duration
+	events             atomic.Pointer[chan Event]
+	errorSampling      int
+	minAttempts        int
+	onError            func(error)
+	onErrorStop        func(error) bool
+	notify             func(err error, attempt int, next time.Duration)
+	onPanic            func(interface{})
+	onSuccess          func(attempt int)
+	onGiveUp           func(lastErr error)
+	observer           Observer
+	logger             *slog.Logger
+	breaker            *breaker
+	limiter            Limiter
+	initialJitter      time.Duration
+	randMu             sync.Mutex
+	rand               *rand.Rand
+	delayFirst         bool
+	retryIf            func(error) bool
+	captureStack       bool
+	repanic            bool
+	noRecover          bool
+	stop               <-chan struct{}
+	attemptTimeout     time.Duration
+	joinErrors         bool
+	wrapErrors         bool
+	exhaustedErrors    bool
+	retryContextErrors bool
+	sleeper            Sleeper
+}
+
+// Option configures a Retryer. It returns an error if the configuration
+// is invalid.
+type Option func(*Retryer) error
+
+// NewRetryer creates a Retryer. With no options, it behaves like
+// Retry(f, -1, nil); it runs f until it succeeds, sleeping the default
+// period between two attempts; see DefaultPeriod.
+// It returns an error, wrapping ErrInvalidOption, if an option is invalid.
+func NewRetryer(opts ...Option) (*Retryer, error) {
+	r := &Retryer{
+		maxAttempts: -1,
+		backoff:     ConstantBackoff(0),
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	if p, ok := r.backoff.(ConstantBackoff); ok && p <= 0 && r.defaultPeriod > 0 {
+		r.backoff = ConstantBackoff(r.defaultPeriod)
+	}
+	return r, nil
+}
+
+// WithMaxAttempts sets the total number of times f is run, including
+// the first one; the same as numberOfRetries in Retry. If n < 0, it runs
+// forever as long as there are any errors. n must not be 0.
+func WithMaxAttempts(n int) Option {
+	return func(r *Retryer) error {
+		if n == 0 {
+			return errZeroAttempts
+		}
+		r.maxAttempts = n
+		return nil
+	}
+}
+
+// errZeroAttempts is returned for a count of 0 attempts, by WithMaxAttempts,
+// and by the functions of this package, without running f.
+var errZeroAttempts = fmt.Errorf("%w: max attempts is 0, f would never run", ErrInvalidOption)
+
+// WithMaxRetries sets the number of times f is run again, after the first
+// attempt failed; so f is run at most n+1 times. If n < 0, it runs forever
+// as long as there are any errors. n == math.MaxInt is taken as
+// math.MaxInt attempts, since n+1 would overflow.
+func WithMaxRetries(n int) Option {
+	switch {
+	case n < 0:
+		return WithMaxAttempts(-1)
+	case n == math.MaxInt:
+		return WithMaxAttempts(math.MaxInt)
+	}
+	return WithMaxAttempts(n + 1)
+}
+
+// WithMinAttempts makes the Retryer run f at least n times, if it keeps
+// failing, even when WithMaxElapsedTime, or the deadline of the context,
+// would stop it earlier; once out of time, the remaining attempts run
+// without sleeping. So it can go past WithMaxElapsedTime. It does not go
+// past the limit of WithMaxAttempts; and a permanent error, or a context
+// that is done, still stops retrying. n must not be negative.
+func WithMinAttempts(n int) Option {
+	return func(r *Retryer) error {
+		if n < 0 {
+			return fmt.Errorf("%w: negative min attempts %d", ErrInvalidOption, n)
+		}
+		r.minAttempts = n
+		return nil
+	}
+}
+
+// WithMaxElapsedTime stops retrying once d has passed since the first
+// attempt, even if there are attempts left. The last sleep is shortened
+// so it does not go past d, and is followed by a final attempt. Then
+// the error of that attempt is returned, wrapped in a TimeoutError.
+// If d == 0, there is no time limit. d must not be negative.
+func WithMaxElapsedTime(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative max elapsed time %v", ErrInvalidOption, d)
+		}
+		r.maxElapsedTime = d
+		return nil
+	}
+}
+
+// WithDefaultPeriod sets the period between two attempts, used by this
+// Retryer when none is given by WithPeriod, or WithBackoff; instead of
+// the package default, DefaultPeriod(). So different parts of a program
+// can have different defaults, without changing the package one.
+// If d == 0, DefaultPeriod() is used. d must not be negative.
+func WithDefaultPeriod(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative default period %v", ErrInvalidOption, d)
+		}
+		r.defaultPeriod = d
+		return nil
+	}
+}
+
+// WithPeriod sets a fixed period between two attempts, the same as
+// WithBackoff(ConstantBackoff(d)). If d == 0, it does not sleep at all,
+// and retries immediately, like Retry with a period of 0. Without any
+// period option, the default period is used; see WithDefaultPeriod.
+// d must not be negative.
+func WithPeriod(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative period %v", ErrInvalidOption, d)
+		}
+		if d == 0 {
+			r.backoff = immediate{}
+			return nil
+		}
+		r.backoff = ConstantBackoff(d)
+		return nil
+	}
+}
+
+// WithMaxInterval caps the period between two attempts, computed by
+// the backoff, at d; so an ExponentialBackoff without a MaxInterval of
+// its own plateaus at d, instead of growing to hours when retrying forever.
+// The cap applies before the randomization of WithRandomizationFactor, so
+// the periods still vary around d; but after the one of the backoff itself,
+// which then flattens at d. So to cap a backoff, make it deterministic,
+// and randomize it with WithRandomizationFactor.
+// A RetryAfter suggested by an error is not capped. If d == 0, there is
+// no cap. d must not be negative.
+func WithMaxInterval(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative max interval %v", ErrInvalidOption, d)
+		}
+		r.maxInterval = d
+		return nil
+	}
+}
+
+// WithMultiplier makes the period between two attempts grow
+// exponentially: after attempt n, it is period * factor^(n-1), rounded to
+// the nearest nanosecond, where period is the one set by WithPeriod, or
+// computed by the backoff. Use WithMaxInterval to cap it. If factor == 1,
+// the period stays fixed. factor must be at least 1.
+func WithMultiplier(factor float64) Option {
+	return func(r *Retryer) error {
+		if math.IsNaN(factor) || math.IsInf(factor, 0) || factor < 1 {
+			return fmt.Errorf("%w: multiplier %v is not at least 1", ErrInvalidOption, factor)
+		}
+		r.multiplier = factor
+		return nil
+	}
+}
+
+// WithRandomizationFactor randomizes each period between two attempts,
+// to a value in [period - factor*period, period + factor*period]; so many
+// clients failing at the same time do not all retry at the same time.
+// It applies to any period, computed by the backoff, or set by WithPeriod;
+// after WithMultiplier, and WithMaxInterval. A RetryAfter suggested by
+// an error is not randomized. The random values are drawn as set by
+// WithRand. It adds to any randomization of the backoff itself, so use it
+// with a deterministic one. If factor == 0, periods are not randomized.
+// Without it, the package default is used, unless the backoff randomizes
+// its periods itself; see SetRandomizationFactor. factor must be in
+// [0, 1].
+func WithRandomizationFactor(factor float64) Option {
+	return func(r *Retryer) error {
+		if math.IsNaN(factor) || factor < 0 || factor > 1 {
+			return fmt.Errorf("%w: randomization factor %v is not in [0, 1]", ErrInvalidOption, factor)
+		}
+		r.randomization = factor
+		r.hasRandomization = true
+		return nil
+	}
+}
+
+// WithResetAfter makes the Retryer start its backoff over, if more than
+// d has passed since the previous failed attempt; so for a long-lived f,
+// like a subscriber that keeps its connection for hours, a later failure
+// starts again from the first, short, period, not the escalated one.
+// d should be longer than the longest period, otherwise the backoff
+// starts over after every failure. If d == 0, it never starts over.
+// d must not be negative.
+func WithResetAfter(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative reset after %v", ErrInvalidOption, d)
+		}
+		r.resetAfter = d
+		return nil
+	}
+}
+
+// WithDelayHook makes the Retryer call hook, before each sleep between
+// two attempts, with the number of the failed attempt, and the planned
+// period, as computed by the backoff, and limited by WithMaxElapsedTime;
+// the period it returns is slept instead. If it returns 0 or less,
+// the next attempt runs immediately. A panic in hook is not recovered.
+func WithDelayHook(hook func(attempt int, planned time.Duration) time.Duration) Option {
+	return func(r *Retryer) error {
+		r.delayHook = hook
+		return nil
+	}
+}
+
+// WithEstimatedAttemptDuration tells the Retryer how long an attempt is
+// expected to take. If the deadline of the context would pass before
+// the next attempt could finish, that is, after the next sleep plus d,
+// it gives up, instead of sleeping and starting a doomed attempt, and
+// returns the error of the last attempt. d must not be negative.
+func WithEstimatedAttemptDuration(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative estimated attempt duration %v", ErrInvalidOption, d)
+		}
+		r.estimatedAttempt = d
+		return nil
+	}
+}
+
+// WithBackoff makes the Retryer compute the period between two attempts
+// using b. If b is nil, the default period is used.
+func WithBackoff(b Backoff) Option {
+	return func(r *Retryer) error {
+		if b == nil {
+			b = ConstantBackoff(0)
+		}
+		r.backoff = b
+		return nil
+	}
+}
+
+// PeriodFunc computes the period to sleep after a failed attempt, from
+// the number of the attempt, starting at 1, and its error.
+type PeriodFunc func(attempt int, lastErr error) time.Duration
+
+// WithPeriodFunc makes the Retryer call f, after each failed attempt,
+// to compute the period to sleep before the next one; instead of using
+// the backoff, or the RetryAfter of the error. A negative period is
+// treated as 0. If f is nil, the backoff is used.
+func WithPeriodFunc(f PeriodFunc) Option {
+	return func(r *Retryer) error {
+		r.periodFunc = f
+		return nil
+	}
+}
+
+// WithOnError sets a function to be called with the error of
+// each failed attempt.
+func WithOnError(onError func(error)) Option {
+	return func(r *Retryer) error {
+		r.onError = onError
+		return nil
+	}
+}
+
+// WithNotify sets a function to be called after each failed attempt, with
+// its error, its number, starting at 1, and the period the Retryer is about
+// to sleep before the next attempt, after any backoff, jitter, and delay
+// hook; which is 0 after the last attempt. It is called as well as the
+// function set by WithOnError. See RetryNotify.
+func WithNotify(notify func(err error, attempt int, next time.Duration)) Option {
+	return func(r *Retryer) error {
+		r.notify = notify
+		return nil
+	}
+}
+
+// WithErrorSampling makes the Retryer call the functions set by WithOnError,
+// and WithPanicHandler, only for every nth failed attempt of a call; and
+// always for the first one, and the last one, before it stops retrying.
+// It keeps a long running Retryer, that keeps failing, from flooding
+// the logs. If n <= 1, they are called for every failed attempt.
+func WithErrorSampling(n int) Option {
+	return func(r *Retryer) error {
+		r.errorSampling = n
+		return nil
+	}
+}
+
+// WithPanicHandler sets a function to be called with the recovered value
+// of each attempt that panicked, instead of calling the function set by
+// WithOnError. If onPanic is nil, panics are passed to that function,
+// as errors.
+func WithPanicHandler(onPanic func(interface{})) Option {
+	return func(r *Retryer) error {
+		r.onPanic = onPanic
+		return nil
+	}
+}
+
+// WithOnSuccess sets a function to be called once f succeeds, with
+// the number of the attempt, starting at 1.
+func WithOnSuccess(onSuccess func(attempt int)) Option {
+	return func(r *Retryer) error {
+		r.onSuccess = onSuccess
+		return nil
+	}
+}
+
+// WithOnGiveUp sets a function to be called once, with the last error,
+// when the Retryer gives up because it ran out of attempts, or time;
+// not when it stops because of a permanent error, or a cancelled context.
+func WithOnGiveUp(onGiveUp func(lastErr error)) Option {
+	return func(r *Retryer) error {
+		r.onGiveUp = onGiveUp
+		return nil
+	}
+}
+
+// WithObserver makes the Retryer report each attempt to o, as it runs;
+// to collect metrics, for example. If o is nil, nothing is reported.
+func WithObserver(o Observer) Option {
+	return func(r *Retryer) error {
+		r.observer = o
+		return nil
+	}
+}
+
+// WithLogger makes the Retryer log each failed attempt to l, at the Warn
+// level, with the attempt, max, next_delay and error attributes; and
+// giving up, at the Error level. If l is nil, nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(r *Retryer) error {
+		r.logger = l
+		return nil
+	}
+}
+
+// WithRateLimiter makes the Retryer wait on l before each attempt,
+// including the first one; a *rate.Limiter from golang.org/x/time/rate
+// can be used, and shared by many Retryers, to cap the rate of attempts
+// across all of them. Since the limiter keeps filling while sleeping
+// between two attempts, the effective period is about the longer one of
+// the period and the wait. If waiting fails, because ctx is done for
+// example, retrying stops with that error. If l is nil, there is no limit.
+func WithRateLimiter(l Limiter) Option {
+	return func(r *Retryer) error {
+		r.limiter = l
+		return nil
+	}
+}
+
+// WithInitialJitter makes the Retryer sleep a random period in
+// [0, window), before the first attempt; so many instances started
+// at the same time, like scheduled jobs, do not all run at once.
+// If window == 0, the first attempt runs immediately.
+// window must not be negative.
+func WithInitialJitter(window time.Duration) Option {
+	return func(r *Retryer) error {
+		if window < 0 {
+			return fmt.Errorf("%w: negative initial jitter %v", ErrInvalidOption, window)
+		}
+		r.initialJitter = window
+		return nil
+	}
+}
+
+// WithRand makes the Retryer draw its random periods, like the ones of
+// WithInitialJitter, and WithRandomizationFactor, from rnd instead of
+// the global source; to make them reproducible in tests, or to avoid
+// contending on the lock of the global source. The Retryer guards its own use of rnd, so it can still be used
+// from many goroutines; but rnd must not be used elsewhere at the same time.
+// A Backoff keeps using its own source, like ExponentialBackoff.Rand.
+// If rnd is nil, the global source is used.
+func WithRand(rnd *rand.Rand) Option {
+	return func(r *Retryer) error {
+		r.rand = rnd
+		return nil
+	}
+}
+
+// WithDelayFirst makes the Retryer sleep the first period of its backoff
+// before the first attempt too, instead of running it immediately; so
+// it waits, then runs. It adds up with WithInitialJitter.
+func WithDelayFirst() Option {
+	return func(r *Retryer) error {
+		r.delayFirst = true
+		return nil
+	}
+}
+
+// WithRetryIf sets a predicate deciding if a failed attempt should be
+// retried. If it returns false, the Retryer stops immediately, without
+// sleeping, and returns that error. If shouldRetry is nil, all errors
+// are retried.
+func WithRetryIf(shouldRetry func(error) bool) Option {
+	return func(r *Retryer) error {
+		r.retryIf = shouldRetry
+		return nil
+	}
+}
+
+// WithStackTrace captures the stack trace when a panic is recovered,
+// available from the Stack() []byte method of the error, and included,
+// truncated, in its message. It is off by default, to keep recovering cheap.
+func WithStackTrace() Option {
+	return func(r *Retryer) error {
+		r.captureStack = true
+		return nil
+	}
+}
+
+// WithRepanic makes the Retryer panic again with the original value,
+// if the last attempt ended in a recovered panic; after giving up.
+func WithRepanic() Option {
+	return func(r *Retryer) error {
+		r.repanic = true
+		return nil
+	}
+}
+
+// WithNoRecover makes the Retryer not recover panics; a panic in f
+// propagates immediately, with its own stack trace. Since no deferred
+// recover is set up, each attempt is a little faster too; neither way
+// allocates.
+func WithNoRecover() Option {
+	return func(r *Retryer) error {
+		r.noRecover = true
+		return nil
+	}
+}
+
+// WithStopChan makes the Retryer stop once stop is closed, including
+// while sleeping between two attempts, and return ErrStopped.
+func WithStopChan(stop <-chan struct{}) Option {
+	return func(r *Retryer) error {
+		r.stop = stop
+		return nil
+	}
+}
+
+// WithAttemptTimeout makes each attempt fail with a TimeoutError, if it does
+// not finish within d, and moves on to the next attempt. It is meant to be
+// used with DoContext; f is run in a goroutine, and its context is cancelled
+// when d passes. f must respect the cancellation of its context, otherwise
+// the goroutine running it leaks, until f returns.
+// A panic in f can not be propagated with WithNoRecover; it crashes the program.
+func WithAttemptTimeout(d time.Duration) Option {
+	return func(r *Retryer) error {
+		if d < 0 {
+			return fmt.Errorf("%w: negative attempt timeout %v", ErrInvalidOption, d)
+		}
+		r.attemptTimeout = d
+		return nil
+	}
+}
+
+// WithJoinErrors makes the Retryer return the errors of all failed
+// attempts, joined by errors.Join, instead of only the last one.
+func WithJoinErrors() Option {
+	return func(r *Retryer) error {
+		r.joinErrors = true
+		return nil
+	}
+}
+
+// WithErrorWrapping makes the Retryer wrap the error of each failed
+// attempt as "attempt 2/3: err", before passing it on, and returning it;
+// or as "attempt 2: err", when retrying forever. errors.Is and errors.As
+// still see the original error.
+func WithErrorWrapping() Option {
+	return func(r *Retryer) error {
+		r.wrapErrors = true
+		return nil
+	}
+}
+
+// WithExhaustedError makes the Retryer wrap the error it returns, when it
+// gives up because it ran out of attempts, or of time, with ErrExhausted;
+// as "retry: retries exhausted after 3 attempts: err". So errors.Is(err,
+// ErrExhausted) tells it apart from an error that stopped retrying early,
+// like a permanent one. errors.Is and errors.As still see the original
+// error.
+func WithExhaustedError() Option {
+	return func(r *Retryer) error {
+		r.exhaustedErrors = true
+		return nil
+	}
+}
+
+// WithRetryContextErrors makes the Retryer treat errors that are
+// context.Canceled or context.DeadlineExceeded like any other. By default,
+// an attempt failing with context.Canceled stops retrying immediately,
+// returning that error; since retrying after a shutdown has begun is
+// pointless. So does one failing with context.DeadlineExceeded, once
+// the context passed to DoContext is done; until then, it is retried,
+// like the timeout of a single call.
+func WithRetryContextErrors() Option {
+	return func(r *Retryer) error {
+		r.retryContextErrors = true
+		return nil
+	}
+}
+
+// WithSleeper makes the Retryer pause between two attempts using s,
+// instead of a timer. It is meant for driving retries with a fake clock
+// in tests. If s is nil, a timer is used.
+func WithSleeper(s Sleeper) Option {
+	return func(r *Retryer) error {
+		r.sleeper = s
+		return nil
+	}
+}
+
+// Do runs f, retrying it based on the policy of the Retryer.
+// It returns the error of the last attempt, or nil if an attempt succeeded.
+func (r *Retryer) Do(f func() error) error {
+	return r.do(context.Background(), ignoreAttempt(f))
+}
+
+// DoContext works like Do, but stops as soon as ctx is done, including
+// while sleeping between two attempts, and returns ctx.Err(); or the error
+// of the last attempt, if it is context.Canceled or DeadlineExceeded,
+// see WithRetryContextErrors. ctx is passed to f, so it can abort its own
+// work.
+func (r *Retryer) DoContext(ctx context.Context, f func(ctx context.Context) error) error {
+	return r.do(ctx, withContext(f))
+}
+
+// DoStats works like Do, but returns the stats of the run.
+func (r *Retryer) DoStats(f func() error) Stats {
+	return r.run(context.Background(), ignoreAttempt(f))
+}
+
+// Wrap returns a function that runs f, retrying it based on the policy
+// of the Retryer, each time it is called; and returns the error of the last
+// attempt, like Do. It can be passed to anything that accepts
+// a func() error, like a task queue.
+func (r *Retryer) Wrap(f func() error) func() error {
+	return func() error { return r.Do(f) }
+}
+
+// Stats describes a run of a retried function.
+type Stats struct {
+	// Attempts is the number of times the function was run.
+	Attempts int
+	// Failures is the number of attempts that failed, or panicked.
+	Failures int
+	// Elapsed is the time spent, including sleeps between attempts.
+	Elapsed time.Duration
+	// LastErr is the error of the last attempt, or nil if an attempt
+	// succeeded. If the context was done, it is ctx.Err().
+	LastErr error
+	// Outcome tells how the run ended.
+	Outcome Outcome
+}
+
+// Outcome tells how a run of a retried function ended.
+type Outcome int
+
+// Outcomes of a run.
+const (
+	// Succeeded means an attempt succeeded.
+	Succeeded Outcome = iota
+	// Failed means the last attempt returned an error, or retrying
+	// was stopped, by a context for example.
+	Failed
+	// Panicked means the last attempt panicked.
+	Panicked
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Panicked:
+		return "panicked"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+func newRetryer(numberOfRetries int, onError func(error), period []time.Duration) *Retryer {
+	var b Backoff = ConstantBackoff(0)
+	if len(period) > 0 {
+		b = ConstantBackoff(period[0])
+		if period[0] <= 0 {
+			b = immediate{}
+		}
+	}
+	return &Retryer{
+		maxAttempts: numberOfRetries,
+		backoff:     b,
+		onError:     onError,
+	}
+}
+
+// attemptFunc is the function run by a Retryer, in each attempt. It is
+// an interface, implemented by a func type per signature, so adapting f
+// to it does not allocate a closure.
+type attemptFunc interface {
+	run(ctx context.Context, attempt int) error
+}
+
+type (
+	plainFunc   func() error
+	attemptOnly func(attempt int) error
+	contextOnly func(ctx context.Context) error
+)
+
+func (f plainFunc) run(context.Context, int) error             { return f() }
+func (f attemptOnly) run(_ context.Context, attempt int) error { return f(attempt) }
+func (f contextOnly) run(ctx context.Context, _ int) error     { return f(ctx) }
+
+func (r *Retryer) do(ctx context.Context, f attemptFunc) error {
+	return r.run(ctx, f).LastErr
+}
+
+func (r *Retryer) run(ctx context.Context, f attemptFunc) (st Stats) {
+	startedAt := time.Now()
+	var errs []error
+	var gaveUp, timedOut bool
+	defer func() {
+		st.Elapsed = time.Since(startedAt)
+		switch pe := asPanic(st.LastErr); {
+		case st.LastErr == nil:
+			st.Outcome = Succeeded
+		case pe != nil:
+			st.Outcome = Panicked
+			if r.repanic {
+				panic(pe.Value)
+			}
+		default:
+			st.Outcome = Failed
+		}
+		if r.joinErrors && st.LastErr != nil {
+			st.LastErr = errors.Join(errs...)
+		}
+		if timedOut && gaveUp {
+			after := r.maxElapsedTime
+			if !r.until.IsZero() {
+				after = st.Elapsed
+			}
+			st.LastErr = TimeoutError{After: after, Overall: true, Err: st.LastErr}
+		}
+		if r.exhaustedErrors && gaveUp {
+			st.LastErr = fmt.Errorf("%w after %d attempts: %w", ErrExhausted, st.Attempts, st.LastErr)
+		}
+	}()
+	if r.stop != nil {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		go func() {
+			select {
+			case <-r.stop:
+				cancel(ErrStopped)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	var deadline time.Time
+	if r.maxElapsedTime > 0 {
+		deadline = startedAt.Add(r.maxElapsedTime)
+	}
+	if !r.until.IsZero() && (deadline.IsZero() || r.until.Before(deadline)) {
+		deadline = r.until
+	}
+	var t timer
+	defer t.stop()
+	if r.maxAttempts == 0 {
+		st.LastErr = errZeroAttempts
+		return
+	}
+	left := r.maxAttempts
+	b := r.newBackoff()
+	if d := r.initialDelay(b); d > 0 && left != 0 {
+		if err := r.sleep(ctx, &t, d); err != nil {
+			st.LastErr = cause(ctx, err)
+			errs = append(errs, st.LastErr)
+			return
+		}
+	}
+	// n is the number of the attempt as seen by the backoff,
+	// which starts over with WithResetAfter.
+	n := 0
+	var lastFailure time.Time
+	for attempt := 1; left != 0; attempt++ {
+		if ctx.Err() != nil {
+			st.LastErr = context.Cause(ctx)
+			errs = append(errs, st.LastErr)
+			return
+		}
+		if left > 0 {
+			left--
+		}
+		if r.limiter != nil {
+			if err := r.limiter.Wait(ctx); err != nil {
+				st.LastErr = cause(ctx, err)
+				errs = append(errs, st.LastErr)
+				return
+			}
+		}
+		if r.breaker != nil {
+			if err := r.breaker.allow(); err != nil {
+				st.LastErr = err
+				errs = append(errs, err)
+				return
+			}
+		}
+		st.Attempts = attempt
+		if r.observer != nil {
+			r.observer.AttemptStarted(attempt)
+		}
+		st.LastErr = r.call(ctx, f, attempt)
+		open := r.breaker != nil && r.breaker.record(st.LastErr)
+		if st.LastErr == nil {
+			if r.onSuccess != nil {
+				r.onSuccess(attempt)
+			}
+			if r.observer != nil {
+				r.observer.Succeeded(attempt)
+			}
+			r.publish(Event{Kind: EventSucceeded, Attempt: attempt})
+			return
+		}
+		st.Failures++
+		n++
+		if r.resetAfter > 0 && !lastFailure.IsZero() && time.Since(lastFailure) > r.resetAfter {
+			r.resetBackoff(b)
+			n = 1
+		}
+		lastFailure = time.Now()
+		p := asPermanent(st.LastErr)
+		if p != nil {
+			st.LastErr = p.Err
+		}
+		if r.wrapErrors {
+			st.LastErr = r.wrap(st.LastErr, attempt)
+		}
+		if r.joinErrors {
+			errs = append(errs, st.LastErr)
+		}
+		next, ok, exhausted := r.next(ctx, b, n, left, p, st.LastErr, deadline)
+		if exhausted && left != 0 && attempt < r.minAttempts {
+			// out of time, but not of the attempts that must run.
+			next, ok, exhausted = 0, true, false
+		}
+		if open {
+			next, ok, exhausted = 0, false, false
+		}
+		// attempts are left, so the time limit ran out.
+		timedOut = exhausted && left != 0
+		if ok && r.delayHook != nil {
+			if next = r.delayHook(attempt, next); next < 0 {
+				next = 0
+			}
+		}
+		if dl, has := ctx.Deadline(); ok && has && time.Until(dl) <= next+r.estimatedAttempt {
+			if attempt < r.minAttempts {
+				next = 0
+			} else {
+				// ctx would be done before the next attempt finishes;
+				// no need to wait for it.
+				next, ok, exhausted = 0, false, true
+			}
+		}
+		report := r.errorSampling <= 1 || st.Failures == 1 || st.Failures%r.errorSampling == 0 || !ok
+		if r.failed(st.LastErr, attempt, next, report) {
+			return
+		}
+		if !ok {
+			if exhausted {
+				gaveUp = true
+				r.gaveUp(st.LastErr, attempt)
+			}
+			return
+		}
+		if err := r.sleep(ctx, &t, next); err != nil {
+			st.LastErr = cause(ctx, err)
+			errs = append(errs, st.LastErr)
+			return
+		}
+	}
+	return
+}
+
+// newBackoff returns the backoff of a single call: a copy of
+// a DecorrelatedJitterBackoff, so concurrent calls do not share its
+// previous period; other backoffs as they are.
+func (r *Retryer) newBackoff() Backoff {
+	if d, ok := r.backoff.(*DecorrelatedJitterBackoff); ok {
+		c := *d
+		c.prev = 0
+		return &c
+	}
+	return r.backoff
+}
+
+// initialDelay returns the period to sleep before the first attempt,
+// and resets the backoff b.
+func (r *Retryer) initialDelay(b Backoff) time.Duration {
+	var d time.Duration
+	if r.delayFirst {
+		d = r.nextBackOff(b, 1)
+	}
+	r.resetBackoff(b)
+	return d + r.jitter(r.initialJitter)
+}
+
+// nextBackOff and resetBackoff hold backoffMu, since b may be shared by
+// concurrent calls; and so may its *rand.Rand, even when copied.
+func (r *Retryer) nextBackOff(b Backoff, attempt int) time.Duration {
+	r.backoffMu.Lock()
+	defer r.backoffMu.Unlock()
+	return b.NextBackOff(attempt)
+}
+
+func (r *Retryer) resetBackoff(b Backoff) {
+	r.backoffMu.Lock()
+	defer r.backoffMu.Unlock()
+	b.Reset()
+}
+
+// jitter returns a random duration in [0, window), drawn from the source
+// set by WithRand.
+func (r *Retryer) jitter(window time.Duration) time.Duration {
+	if r.rand == nil {
+		return jitter(window, nil)
+	}
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	return jitter(window, r.rand)
+}
+
+func (r *Retryer) randomize(b Backoff, d time.Duration) time.Duration {
+	factor := r.randomization
+	if !r.hasRandomization {
+		if randomizes(b) {
+			// the backoff has a randomization of its own, instead.
+			return d
+		}
+		factor = RandomizationFactor()
+	}
+	if factor == 0 {
+		return d
+	}
+	if r.rand == nil {
+		return randomize(d, factor, nil)
+	}
+	r.randMu.Lock()
+	defer r.randMu.Unlock()
+	return randomize(d, factor, r.rand)
+}
+
+// wrap adds the number of the attempt to err.
+func (r *Retryer) wrap(err error, attempt int) error {
+	if r.maxAttempts < 0 {
+		return fmt.Errorf("attempt %d: %w", attempt, err)
+	}
+	return fmt.Errorf("attempt %d/%d: %w", attempt, r.maxAttempts, err)
+}
+
+// cause returns the cause of ctx being done, if it is; otherwise err.
+func cause(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// failed calls the callbacks for a failed attempt, and reports
+// whether one of them asked to stop retrying. The functions set by
+// WithOnError and WithPanicHandler are only called if report is set;
+// see WithErrorSampling.
+func (r *Retryer) failed(err error, attempt int, next time.Duration, report bool) (stop bool) {
+	var pe *PanicError
+	switch {
+	case r.onPanic != nil && errors.As(err, &pe):
+		if report {
+			r.onPanic(pe.Value)
+		}
+	case r.onErrorStop != nil:
+		stop = r.onErrorStop(err)
+	case r.onError != nil && report:
+		r.onError(err)
+	}
+	if r.notify != nil {
+		r.notify(err, attempt, next)
+	}
+	if r.observer != nil {
+		r.observer.AttemptFailed(attempt, err)
+	}
+	r.publish(Event{Kind: EventFailed, Attempt: attempt, Err: err, Delay: next})
+	if r.logger != nil {
+		r.logger.Warn("retry: attempt failed",
+			slog.Int("attempt", attempt),
+			slog.Int("max", r.maxAttempts),
+			slog.Duration("next_delay", next),
+			slog.String("error", err.Error()))
+	}
+	return
+}
+
+// gaveUp calls the callbacks for running out of attempts, or time.
+func (r *Retryer) gaveUp(lastErr error, attempt int) {
+	if r.onGiveUp != nil {
+		r.onGiveUp(lastErr)
+	}
+	if r.observer != nil {
+		r.observer.GaveUp(lastErr)
+	}
+	r.publish(Event{Kind: EventGaveUp, Attempt: attempt, Err: lastErr})
+	if r.logger != nil {
+		r.logger.Error("retry: giving up",
+			slog.Int("attempt", attempt),
+			slog.Int("max", r.maxAttempts),
+			slog.String("error", lastErr.Error()))
+	}
+}
+
+func (r *Retryer) call(ctx context.Context, f attemptFunc, attempt int) error {
+	if r.attemptTimeout <= 0 {
+		return r.try(ctx, f, attempt)
+	}
+	actx, cancel := context.WithTimeout(ctx, r.attemptTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- r.try(actx, f, attempt) }()
+	select {
+	case err := <-done:
+		if err == nil || actx.Err() == nil {
+			return err
+		}
+	case <-actx.Done():
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return TimeoutError{After: r.attemptTimeout}
+}
+
+func (r *Retryer) try(ctx context.Context, f attemptFunc, attempt int) error {
+	if r.noRecover {
+		return f.run(ctx, attempt)
+	}
+	return try(func() error { return f.run(ctx, attempt) }, r.captureStack)
+}
+
+// next returns the period to sleep after a failed attempt. If there
+// should be no more attempts, ok is false; and exhausted tells if that is
+// because the attempts, or the time, ran out.
+func (r *Retryer) next(ctx context.Context, b Backoff, attempt, left int, p *PermanentError, err error, deadline time.Time) (d time.Duration, ok, exhausted bool) {
+	if p != nil {
+		return 0, false, false
+	}
+	if r.retryIf != nil && !r.retryIf(err) {
+		return 0, false, false
+	}
+	if !retryPanic(err) {
+		return 0, false, false
+	}
+	if !r.retryContextErrors && (errors.Is(err, context.Canceled) ||
+		ctx.Err() != nil && errors.Is(err, context.DeadlineExceeded)) {
+		return 0, false, false
+	}
+	if left == 0 {
+		return 0, false, true
+	}
+	d = r.delay(b, attempt, err)
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return 0, false, true
+		}
+		if d > remaining {
+			d = remaining
+		}
+	}
+	return d, true, false
+}
+
+func (r *Retryer) delay(b Backoff, attempt int, err error) time.Duration {
+	if errors.Is(err, ErrRetryNow) {
+		return 0
+	}
+	if r.periodFunc != nil {
+		if d := r.periodFunc(attempt, err); d > 0 {
+			return d
+		}
+		return 0
+	}
+	d := r.nextBackOff(b, attempt)
+	if r.multiplier > 1 {
+		d = exponential(d, r.multiplier, 0, attempt)
+	}
+	if r.maxInterval > 0 && d > r.maxInterval {
+		d = r.maxInterval
+	}
+	d = r.randomize(b, d)
+	var ra RetryAfterError
+	if errors.As(err, &ra) {
+		d = ra.RetryAfter()
+	}
+	return d
+}
+
+func ignoreAttempt(f func() error) attemptFunc { return plainFunc(f) }
+
+func withAttempt(f func(attempt int) error) attemptFunc { return attemptOnly(f) }
+
+func withContext(f func(ctx context.Context) error) attemptFunc { return contextOnly(f) }
+
+func (r *Retryer) sleep(ctx context.Context, t *timer, d time.Duration) error {
+	if r.sleeper != nil {
+		return r.sleeper.Sleep(ctx, d)
+	}
+	return t.sleep(ctx, d)
+}
+
+// Observer is notified of each attempt of a Retryer; see WithObserver.
+// It is meant to feed metrics, like Prometheus counters, without coupling
+// this package to a metrics library. Its methods are called synchronously,
+// from the goroutine running the Retryer, so they should return quickly.
+type Observer interface {
+	// AttemptStarted is called before each attempt, with its number,
+	// starting at 1.
+	AttemptStarted(attempt int)
+	// AttemptFailed is called after each failed attempt, with its error.
+	AttemptFailed(attempt int, err error)
+	// Succeeded is called once f succeeds.
+	Succeeded(attempt int)
+	// GaveUp is called when the Retryer runs out of attempts, or time;
+	// the same as the function set by WithOnGiveUp.
+	GaveUp(lastErr error)
+}
+
+// EventKind tells what an Event is about.
+type EventKind int
+
+// Kinds of events.
+const (
+	// EventFailed is published after each failed attempt.
+	EventFailed EventKind = iota
+	// EventSucceeded is published once f succeeds.
+	EventSucceeded
+	// EventGaveUp is published when the Retryer runs out of attempts,
+	// or time; see WithOnGiveUp.
+	EventGaveUp
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventFailed:
+		return "failed"
+	case EventSucceeded:
+		return "succeeded"
+	case EventGaveUp:
+		return "gave up"
+	}
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// Event describes a step of a Retryer. See Retryer.Events.
+type Event struct {
+	Kind EventKind
+	// Attempt is the number of the attempt, starting at 1.
+	Attempt int
+	// Err is the error of the attempt; nil for EventSucceeded.
+	Err error
+	// Delay is the period to sleep before the next attempt, for EventFailed.
+	Delay time.Duration
+}
+
+// eventsBuffer is the capacity of the channel returned by Events.
+const eventsBuffer = 64
+
+// Events returns a channel, on which the events of all the calls of r are
+// published, as they happen. Events are dropped if the channel is full,
+// so a slow consumer, or none, does not stall retrying. The channel is
+// created on the first call, and the same one is returned afterwards;
+// it is never closed, since r can be used again at any time.
+func (r *Retryer) Events() <-chan Event {
+	if ch := r.events.Load(); ch != nil {
+		return *ch
+	}
+	ch := make(chan Event, eventsBuffer)
+	if !r.events.CompareAndSwap(nil, &ch) {
+		return *r.events.Load()
+	}
+	return ch
+}
+
+func (r *Retryer) publish(e Event) {
+	ch := r.events.Load()
+	if ch == nil {
+		return
+	}
+	select {
+	case *ch <- e:
+	default:
+	}
+}
+
+// Limiter blocks until an attempt is allowed to run, or ctx is done.
+// It is satisfied by *rate.Limiter from golang.org/x/time/rate.
+// See WithRateLimiter.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// Sleeper pauses between two attempts.
+type Sleeper interface {
+	// Sleep pauses for d, or until ctx is done, in which case
+	// it returns ctx.Err().
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// SleeperFunc is an adapter to use an ordinary function as a Sleeper.
+type SleeperFunc func(ctx context.Context, d time.Duration) error
+
+// Sleep calls fn(ctx, d).
+func (fn SleeperFunc) Sleep(ctx context.Context, d time.Duration) error { return fn(ctx, d) }
+
+// sleep pauses for d, or until ctx is done. The timer is stopped on return,
+// so nothing is left behind when ctx fires first.
+func sleep(ctx context.Context, d time.Duration) error {
+	var t timer
+	defer t.stop()
+	return t.sleep(ctx, d)
+}
+
+// timer is reused to pause between many attempts, so a new one is not
+// allocated for each of them. It must be stopped once done with.
+type timer struct {
+	t *time.Timer
+}
+
+// sleep pauses for d, or until ctx is done. If ctx is already done,
+// like when it was cancelled by a callback of the failed attempt,
+// it returns immediately.
+func (t *timer) sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.t == nil {
+		t.t = time.NewTimer(d)
+	} else {
+		t.t.Reset(d)
+	}
+	select {
+	case <-ctx.Done():
+		if !t.t.Stop() {
+			select {
+			case <-t.t.C:
+			default:
+			}
+		}
+		return ctx.Err()
+	case <-t.t.C:
+		return nil
+	}
+}
+
+func (t *timer) stop() {
+	if t.t != nil {
+		t.t.Stop()
+	}
+}
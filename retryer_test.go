@@ -0,0 +1,1636 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustRetryer(opts ...Option) *Retryer {
+	r, err := NewRetryer(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+type fakeSleeper struct {
+	delays []time.Duration
+}
+
+func (s *fakeSleeper) Sleep(ctx context.Context, d time.Duration) error {
+	s.delays = append(s.delays, d)
+	return ctx.Err()
+}
+
+func TestRetryerDo(t *testing.T) {
+	var sum, errs int64
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithPeriod(time.Millisecond*10),
+		WithOnError(func(error) { atomic.AddInt64(&errs, 1) }))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+	assert.Equal(t, int64(3), errs)
+}
+
+func TestRetryerMaxAttemptsAndRetries(t *testing.T) {
+	count := func(opt Option) int64 {
+		var sum int64
+		mustRetryer(opt, WithSleeper(&fakeSleeper{})).Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+		return sum
+	}
+	assert.Equal(t, int64(3), count(WithMaxAttempts(3)))
+	assert.Equal(t, int64(4), count(WithMaxRetries(3)))
+	assert.Equal(t, int64(1), count(WithMaxAttempts(1)))
+	assert.Equal(t, int64(1), count(WithMaxRetries(0)))
+	assert.Equal(t, -1, mustRetryer(WithMaxRetries(-1)).maxAttempts)
+	assert.Equal(t, math.MaxInt, mustRetryer(WithMaxRetries(math.MaxInt)).maxAttempts)
+	assert.Equal(t, math.MaxInt, mustRetryer(WithMaxRetries(math.MaxInt-1)).maxAttempts)
+}
+
+func TestNewRetryerInvalid(t *testing.T) {
+	for _, opt := range []Option{
+		WithMaxAttempts(0),
+		WithPeriod(-time.Second),
+		WithMaxElapsedTime(-time.Second),
+		WithAttemptTimeout(-time.Second),
+	} {
+		r, err := NewRetryer(WithMaxRetries(2), opt)
+		assert.Nil(t, r)
+		assert.True(t, errors.Is(err, ErrInvalidOption), err)
+	}
+	_, err := NewRetryer(WithMaxAttempts(0))
+	assert.EqualError(t, err, "retry: invalid option: max attempts is 0, f would never run")
+}
+
+func TestRetryZeroAttempts(t *testing.T) {
+	var sum int64
+	err := Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	}, 0, nil)
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+	assert.EqualError(t, err, "retry: invalid option: max attempts is 0, f would never run")
+	assert.Equal(t, int64(0), sum)
+
+	st := RetryStats(func() error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	}, 0, nil)
+	assert.Equal(t, 0, st.Attempts)
+	assert.Equal(t, Failed, st.Outcome)
+	assert.True(t, errors.Is(st.LastErr, ErrInvalidOption))
+	assert.Equal(t, int64(0), sum)
+
+	v, err := RetryResult(func() (int, error) {
+		atomic.AddInt64(&sum, 1)
+		return 1, nil
+	}, 0, nil)
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+	assert.Equal(t, 0, v)
+	assert.Equal(t, int64(0), sum)
+
+	err = RetryContext(context.Background(), func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	}, 0, nil)
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+	assert.Equal(t, int64(0), sum)
+}
+
+func TestRetryerReuse(t *testing.T) {
+	r := mustRetryer(WithMaxAttempts(2), WithPeriod(time.Millisecond*10))
+	for i := 0; i < 3; i++ {
+		var sum int64
+		r.Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+		assert.Equal(t, int64(2), sum)
+	}
+}
+
+func TestRetryerDefault(t *testing.T) {
+	r := mustRetryer()
+	assert.Equal(t, -1, r.maxAttempts)
+	assert.Equal(t, time.Second*5, r.backoff.NextBackOff(1))
+
+	var sum int64
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestRetryerBackoff(t *testing.T) {
+	var calls []time.Time
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond * 20, Multiplier: 3}))
+	r.Do(func() error {
+		calls = append(calls, time.Now())
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, 3, len(calls))
+	assert.InDelta(t, float64(time.Millisecond*20), float64(calls[1].Sub(calls[0])), float64(time.Millisecond*15))
+	assert.InDelta(t, float64(time.Millisecond*60), float64(calls[2].Sub(calls[1])), float64(time.Millisecond*15))
+}
+
+func TestRetryerDoStats(t *testing.T) {
+	r := mustRetryer(WithMaxAttempts(4), WithSleeper(&fakeSleeper{}))
+	st := r.DoStats(func() error { panic("X") })
+	assert.Equal(t, 4, st.Attempts)
+	assert.Equal(t, "X", st.LastErr.(*PanicError).CausedBy())
+}
+
+func TestRetryerRepanic(t *testing.T) {
+	var sum int64
+	r := mustRetryer(WithMaxAttempts(3), WithRepanic(), WithSleeper(&fakeSleeper{}))
+	assert.PanicsWithValue(t, "X", func() {
+		r.Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			panic("X")
+		})
+	})
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryerRepanicLastAttempt(t *testing.T) {
+	var sum int64
+	r := mustRetryer(WithMaxAttempts(3), WithRepanic(), WithSleeper(&fakeSleeper{}))
+	var err error
+	assert.NotPanics(t, func() {
+		err = r.Do(func() error {
+			if atomic.AddInt64(&sum, 1) < 3 {
+				panic("X")
+			}
+			return errors.Errorf("DUMMY")
+		})
+	})
+	assert.EqualError(t, err, "DUMMY")
+
+	sum = 0
+	assert.NotPanics(t, func() {
+		err = r.Do(func() error {
+			if atomic.AddInt64(&sum, 1) < 2 {
+				panic("X")
+			}
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func TestRetryerNoRecover(t *testing.T) {
+	var sum, errs int64
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithNoRecover(),
+		WithOnError(func(error) { atomic.AddInt64(&errs, 1) }),
+		WithSleeper(&fakeSleeper{}))
+	assert.PanicsWithValue(t, "X", func() {
+		r.Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			panic("X")
+		})
+	})
+	assert.Equal(t, int64(1), sum)
+	assert.Equal(t, int64(0), errs)
+
+	sum = 0
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryerPanicHandler(t *testing.T) {
+	var (
+		errs   []error
+		panics []interface{}
+	)
+	r := mustRetryer(
+		WithMaxAttempts(4),
+		WithOnError(func(err error) { errs = append(errs, err) }),
+		WithPanicHandler(func(v interface{}) { panics = append(panics, v) }),
+		WithSleeper(&fakeSleeper{}))
+	r.Do(func() error {
+		if len(errs) == len(panics) {
+			panic(len(panics))
+		}
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, []interface{}{0, 1}, panics)
+	assert.Equal(t, 2, len(errs))
+	for _, err := range errs {
+		assert.False(t, IsPanic(err))
+	}
+}
+
+func TestRetryerPanicHandlerUnset(t *testing.T) {
+	var errs []error
+	r := mustRetryer(
+		WithMaxAttempts(2),
+		WithOnError(func(err error) { errs = append(errs, err) }),
+		WithSleeper(&fakeSleeper{}))
+	r.Do(func() error { panic("X") })
+	assert.Equal(t, 2, len(errs))
+	assert.True(t, IsPanic(errs[0]))
+}
+
+func TestRetryerStopChan(t *testing.T) {
+	var sum int64
+	stop := make(chan struct{})
+	r := mustRetryer(
+		WithMaxAttempts(-1),
+		WithPeriod(time.Second*10),
+		WithStopChan(stop),
+		WithOnError(func(error) { close(stop) }))
+	startedAt := time.Now()
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, ErrStopped, err)
+	assert.Equal(t, int64(1), sum)
+	assert.True(t, time.Since(startedAt) < time.Second)
+}
+
+func TestRetryerStopChanClosed(t *testing.T) {
+	var sum int64
+	stop := make(chan struct{})
+	close(stop)
+	r := mustRetryer(WithStopChan(stop))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	})
+	// the stop channel may or may not be seen before the first attempt
+	assert.True(t, err == nil || err == ErrStopped)
+	assert.True(t, sum <= 1)
+}
+
+func TestRetryerStopChanContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := mustRetryer(WithPeriod(time.Second*10), WithStopChan(make(chan struct{})))
+	err := r.DoContext(ctx, func(context.Context) error {
+		cancel()
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestRetryerDoContext(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "V")
+	var sum int64
+	err := mustRetryer(WithMaxAttempts(3), WithSleeper(&fakeSleeper{})).
+		DoContext(ctx, func(ctx context.Context) error {
+			assert.Equal(t, "V", ctx.Value(key{}))
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryerAttemptTimeout(t *testing.T) {
+	var sum int64
+	var errs []error
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithAttemptTimeout(time.Millisecond*20),
+		WithOnError(func(err error) { errs = append(errs, err) }),
+		WithSleeper(&fakeSleeper{}))
+	startedAt := time.Now()
+	err := r.DoContext(context.Background(), func(ctx context.Context) error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), sum)
+	timedOut := TimeoutError{After: time.Millisecond * 20}
+	assert.Equal(t, []error{timedOut, timedOut}, errs)
+	assert.True(t, errors.Is(errs[0], ErrTimeout))
+	assert.True(t, time.Since(startedAt) < time.Millisecond*100)
+}
+
+func TestRetryerAttemptTimeoutParentDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	var errs []error
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithAttemptTimeout(time.Second),
+		WithOnError(func(err error) { errs = append(errs, err) }),
+		WithSleeper(&fakeSleeper{}))
+	err := r.DoContext(ctx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, []error{context.DeadlineExceeded}, errs)
+}
+
+func TestRetryerJoinErrors(t *testing.T) {
+	var sum int64
+	unavailable := errors.Errorf("UNAVAILABLE")
+	timeout := errors.Errorf("TIMEOUT")
+	r := mustRetryer(WithMaxAttempts(3), WithJoinErrors(), WithSleeper(&fakeSleeper{}))
+	err := r.Do(func() error {
+		if atomic.AddInt64(&sum, 1)%2 == 1 {
+			return unavailable
+		}
+		return timeout
+	})
+	assert.True(t, errors.Is(err, unavailable))
+	assert.True(t, errors.Is(err, timeout))
+	assert.Equal(t, "UNAVAILABLE\nTIMEOUT\nUNAVAILABLE", err.Error())
+
+	err = r.Do(func() error { return nil })
+	assert.NoError(t, err)
+}
+
+func TestRetryerJoinErrorsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := mustRetryer(WithMaxAttempts(3), WithJoinErrors(), WithSleeper(&fakeSleeper{}))
+	err := r.DoContext(ctx, func(context.Context) error {
+		cancel()
+		return errors.Errorf("DUMMY")
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, "DUMMY\ncontext canceled", err.Error())
+}
+
+func TestRetryerContextErrors(t *testing.T) {
+	for _, ctxErr := range []error{context.Canceled, context.DeadlineExceeded} {
+		var sum int64
+		s := &fakeSleeper{}
+		ctx, cancel := context.WithCancel(context.Background())
+		err := mustRetryer(WithMaxAttempts(3), WithSleeper(s)).
+			DoContext(ctx, func(context.Context) error {
+				atomic.AddInt64(&sum, 1)
+				cancel()
+				return fmt.Errorf("calling: %w", ctxErr)
+			})
+		assert.True(t, errors.Is(err, ctxErr))
+		assert.Equal(t, "calling: "+ctxErr.Error(), err.Error())
+		assert.Equal(t, int64(1), sum)
+		assert.Empty(t, s.delays)
+	}
+
+	// canceled, even with a context that is not done.
+	var sum int64
+	s := &fakeSleeper{}
+	err := mustRetryer(WithMaxAttempts(3), WithSleeper(s)).
+		DoContext(context.Background(), func(context.Context) error {
+			atomic.AddInt64(&sum, 1)
+			return fmt.Errorf("calling: %w", context.Canceled)
+		})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int64(1), sum)
+	assert.Empty(t, s.delays)
+
+	sum = 0
+	Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		panic(context.Canceled)
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, int64(1), sum)
+
+	// the timeout of a single call is retried, until the context is done.
+	sum = 0
+	err = mustRetryer(WithMaxAttempts(3), WithSleeper(&fakeSleeper{})).
+		DoContext(context.Background(), func(context.Context) error {
+			atomic.AddInt64(&sum, 1)
+			return fmt.Errorf("calling: %w", context.DeadlineExceeded)
+		})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, int64(3), sum)
+
+	sum = 0
+	Retry(func() error {
+		atomic.AddInt64(&sum, 1)
+		panic(context.DeadlineExceeded)
+	}, 3, nil, time.Millisecond)
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryerRetryContextErrors(t *testing.T) {
+	var sum int64
+	err := mustRetryer(WithMaxAttempts(3), WithRetryContextErrors(), WithSleeper(&fakeSleeper{})).
+		Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			return context.Canceled
+		})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(3), sum)
+
+	sum = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	err = mustRetryer(WithMaxAttempts(3), WithRetryContextErrors(), WithSleeper(&fakeSleeper{})).
+		DoContext(ctx, func(context.Context) error {
+			atomic.AddInt64(&sum, 1)
+			cancel()
+			return fmt.Errorf("calling: %w", context.Canceled)
+		})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestRetryerSleeper(t *testing.T) {
+	var sum int64
+	s := &fakeSleeper{}
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithBackoff(&ExponentialBackoff{Period: time.Second, Multiplier: 2}),
+		WithSleeper(s))
+	startedAt := time.Now()
+	r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.True(t, time.Since(startedAt) < time.Millisecond*100)
+	assert.Equal(t, int64(5), sum)
+	assert.Equal(t, []time.Duration{
+		time.Second,
+		time.Second * 2,
+		time.Second * 4,
+		time.Second * 8,
+	}, s.delays)
+}
+
+func TestRetryerSleeperFunc(t *testing.T) {
+	var sum int64
+	stop := errors.Errorf("STOP")
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithSleeper(SleeperFunc(func(context.Context, time.Duration) error { return stop })))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, int64(1), sum)
+}
+
+func TestRetryerMaxElapsedTime(t *testing.T) {
+	var sum int64
+	startedAt := time.Now()
+	r := mustRetryer(
+		WithMaxAttempts(-1),
+		WithPeriod(time.Millisecond*40),
+		WithMaxElapsedTime(time.Millisecond*100))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	elapsed := time.Since(startedAt)
+	assert.EqualError(t, err, "retry: timed out after 100ms: DUMMY")
+	var te TimeoutError
+	assert.True(t, errors.As(err, &te))
+	assert.Equal(t, time.Millisecond*100, te.After)
+	assert.True(t, te.Overall)
+	assert.EqualError(t, te.Err, "DUMMY")
+	assert.True(t, errors.Is(err, ErrTimeout))
+	assert.True(t, IsTemporary(err))
+	// attempts at 0, 40, 80 and a shortened sleep to 100
+	assert.Equal(t, int64(4), sum)
+	assert.InDelta(t, float64(time.Millisecond*100), float64(elapsed), float64(time.Millisecond*20))
+}
+
+func TestRetryerMaxElapsedTimeAttemptsFirst(t *testing.T) {
+	var sum int64
+	r := mustRetryer(
+		WithMaxAttempts(2),
+		WithPeriod(time.Millisecond*10),
+		WithMaxElapsedTime(time.Second))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, int64(2), sum)
+	assert.EqualError(t, err, "DUMMY")
+	assert.False(t, errors.Is(err, ErrTimeout))
+}
+
+func TestRetryWithin(t *testing.T) {
+	var sum int64
+	startedAt := time.Now()
+	err := RetryWithin(time.Millisecond*100, func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	},
+		nil,
+		time.Millisecond*60)
+	assert.EqualError(t, err, "retry: timed out after 100ms: DUMMY")
+	assert.Equal(t, int64(3), sum)
+	assert.True(t, time.Since(startedAt) < time.Millisecond*150)
+}
+
+func TestRetryWithinNoTime(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		var sum int64
+		err := RetryWithin(d, func() error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		}, nil, time.Millisecond)
+		var te TimeoutError
+		assert.True(t, errors.As(err, &te))
+		assert.EqualError(t, te.Err, "DUMMY")
+		assert.Equal(t, int64(1), sum)
+	}
+}
+
+func TestRetryerOnSuccess(t *testing.T) {
+	var successes []int
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithOnSuccess(func(attempt int) { successes = append(successes, attempt) }),
+		WithSleeper(&fakeSleeper{}))
+	r.Do(func() error { return nil })
+	assert.Equal(t, []int{1}, successes)
+
+	var sum int64
+	r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	})
+	assert.Equal(t, []int{1, 3}, successes)
+
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []int{1, 3}, successes)
+}
+
+func TestRetryerOnGiveUp(t *testing.T) {
+	var gaveUp []error
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithOnGiveUp(func(err error) { gaveUp = append(gaveUp, err) }),
+		WithSleeper(&fakeSleeper{}))
+	var sum int64
+	r.Do(func() error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	})
+	assert.Equal(t, 1, len(gaveUp))
+	assert.EqualError(t, gaveUp[0], "DUMMY 3")
+
+	r.Do(func() error { return nil })
+	r.Do(func() error { return Permanent(errors.Errorf("BAD REQUEST")) })
+	assert.Equal(t, 1, len(gaveUp))
+}
+
+func TestRetryerOnGiveUpMaxElapsedTime(t *testing.T) {
+	var gaveUp int64
+	r := mustRetryer(
+		WithPeriod(time.Millisecond*10),
+		WithMaxElapsedTime(time.Millisecond*30),
+		WithOnGiveUp(func(error) { atomic.AddInt64(&gaveUp, 1) }))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, int64(1), gaveUp)
+}
+
+func TestRetryerPeriodFunc(t *testing.T) {
+	s := &fakeSleeper{}
+	var seen []string
+	r := mustRetryer(
+		WithMaxAttempts(4),
+		WithPeriodFunc(func(attempt int, lastErr error) time.Duration {
+			seen = append(seen, lastErr.Error())
+			if attempt == 2 {
+				return -time.Second
+			}
+			return time.Duration(attempt) * time.Second
+		}),
+		WithSleeper(s))
+	var sum int64
+	r.Do(func() error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	})
+	assert.Equal(t, []time.Duration{time.Second, 0, time.Second * 3}, s.delays)
+	assert.Equal(t, []string{"DUMMY 1", "DUMMY 2", "DUMMY 3"}, seen)
+}
+
+func TestRetryerPeriodFuncNil(t *testing.T) {
+	s := &fakeSleeper{}
+	r := mustRetryer(
+		WithMaxAttempts(2),
+		WithPeriod(time.Millisecond*7),
+		WithPeriodFunc(nil),
+		WithSleeper(s))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []time.Duration{time.Millisecond * 7}, s.delays)
+}
+
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) AttemptStarted(attempt int) {
+	o.events = append(o.events, fmt.Sprintf("started %d", attempt))
+}
+
+func (o *recordingObserver) AttemptFailed(attempt int, err error) {
+	o.events = append(o.events, fmt.Sprintf("failed %d: %v", attempt, err))
+}
+
+func (o *recordingObserver) Succeeded(attempt int) {
+	o.events = append(o.events, fmt.Sprintf("succeeded %d", attempt))
+}
+
+func (o *recordingObserver) GaveUp(lastErr error) {
+	o.events = append(o.events, fmt.Sprintf("gave up: %v", lastErr))
+}
+
+func TestRetryerObserver(t *testing.T) {
+	o := &recordingObserver{}
+	r := mustRetryer(WithMaxAttempts(2), WithObserver(o), WithSleeper(&fakeSleeper{}))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []string{
+		"started 1",
+		"failed 1: DUMMY",
+		"started 2",
+		"failed 2: DUMMY",
+		"gave up: DUMMY",
+	}, o.events)
+
+	o.events = nil
+	var sum int64
+	r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 2 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	})
+	assert.Equal(t, []string{
+		"started 1",
+		"failed 1: DUMMY",
+		"started 2",
+		"succeeded 2",
+	}, o.events)
+}
+
+func TestRetryerLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	r := mustRetryer(
+		WithMaxAttempts(2),
+		WithPeriod(time.Millisecond*10),
+		WithLogger(l),
+		WithSleeper(&fakeSleeper{}))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, `level=WARN msg="retry: attempt failed" attempt=1 max=2 next_delay=10ms error=DUMMY
+level=WARN msg="retry: attempt failed" attempt=2 max=2 next_delay=0s error=DUMMY
+level=ERROR msg="retry: giving up" attempt=2 max=2 error=DUMMY
+`, buf.String())
+
+	buf.Reset()
+	r.Do(func() error { return nil })
+	assert.Equal(t, "", buf.String())
+}
+
+// tickLimiter lets an attempt run every period.
+type tickLimiter struct {
+	period time.Duration
+	last   time.Time
+	waits  int
+}
+
+func (l *tickLimiter) Wait(ctx context.Context) error {
+	l.waits++
+	d := l.period - time.Since(l.last)
+	if d > 0 {
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+	l.last = time.Now()
+	return nil
+}
+
+func TestRetryerRateLimiter(t *testing.T) {
+	l := &tickLimiter{period: time.Millisecond * 30}
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithPeriod(time.Millisecond*10),
+		WithRateLimiter(l))
+	start := time.Now()
+	err := r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, 3, l.waits)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Millisecond*60)
+	assert.True(t, elapsed < time.Millisecond*90)
+}
+
+func TestRetryerRateLimiterCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	l := &tickLimiter{period: time.Minute, last: time.Now()}
+	var sum int64
+	start := time.Now()
+	err := mustRetryer(WithRateLimiter(l)).DoContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int64(0), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*200)
+}
+
+func TestRetryerInitialJitter(t *testing.T) {
+	window := time.Millisecond * 100
+	for i := 0; i < 20; i++ {
+		s := &fakeSleeper{}
+		err := mustRetryer(WithInitialJitter(window), WithSleeper(s)).Do(func() error { return nil })
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(s.delays))
+		assert.True(t, s.delays[0] >= 0 && s.delays[0] < window)
+	}
+
+	s := &fakeSleeper{}
+	mustRetryer(WithSleeper(s)).Do(func() error { return nil })
+	assert.Equal(t, 0, len(s.delays))
+
+	_, err := NewRetryer(WithInitialJitter(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestRetryerInitialJitterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var sum int64
+	err := mustRetryer(WithInitialJitter(time.Minute)).DoContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(0), sum)
+}
+
+func TestRetryerDelayFirst(t *testing.T) {
+	s := &fakeSleeper{}
+	var sum int64
+	err := mustRetryer(
+		WithMaxAttempts(2),
+		WithPeriod(time.Millisecond*20),
+		WithDelayFirst(),
+		WithSleeper(s)).
+		Do(func() error {
+			if atomic.AddInt64(&sum, 1) < 2 {
+				return errors.Errorf("DUMMY")
+			}
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Millisecond * 20, time.Millisecond * 20}, s.delays)
+
+	start := time.Now()
+	mustRetryer(WithPeriod(time.Millisecond*30), WithDelayFirst()).Do(func() error { return nil })
+	assert.True(t, time.Since(start) >= time.Millisecond*30)
+}
+
+func TestRetryerDelayFirstBackoff(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(3),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond, Multiplier: 2}),
+		WithDelayFirst(),
+		WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond * 2}, s.delays)
+}
+
+func TestRetryerDelayFirstCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	var sum int64
+	start := time.Now()
+	err := mustRetryer(WithPeriod(time.Minute), WithDelayFirst()).DoContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int64(0), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*200)
+}
+
+func TestRetryerMaxElapsedTimeFinalAttempt(t *testing.T) {
+	var starts []time.Duration
+	start := time.Now()
+	mustRetryer(
+		WithPeriod(time.Millisecond*40),
+		WithMaxElapsedTime(time.Millisecond*60)).
+		Do(func() error {
+			starts = append(starts, time.Since(start))
+			return errors.Errorf("DUMMY")
+		})
+	assert.Equal(t, 3, len(starts))
+	assert.InDelta(t, float64(time.Millisecond*60), float64(starts[2]), float64(time.Millisecond*15))
+}
+
+func TestRetryerContextDeadlineBeforeNextAttempt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var sum int64
+	start := time.Now()
+	err := mustRetryer(WithPeriod(time.Minute)).DoContext(ctx, func(context.Context) error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(1), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*200)
+}
+
+func TestRetryerContextDeadlineGivesUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var (
+		nexts  []time.Duration
+		gaveUp error
+	)
+	err := mustRetryer(
+		WithMaxAttempts(3),
+		WithPeriod(time.Minute),
+		WithExhaustedError(),
+		WithNotify(func(_ error, _ int, next time.Duration) { nexts = append(nexts, next) }),
+		WithOnGiveUp(func(err error) { gaveUp = err })).
+		DoContext(ctx, func(context.Context) error { return errors.Errorf("DUMMY") })
+	assert.True(t, errors.Is(err, ErrExhausted))
+	assert.EqualError(t, err, "retry: retries exhausted after 1 attempts: DUMMY")
+	assert.Equal(t, []time.Duration{0}, nexts)
+	assert.EqualError(t, gaveUp, "DUMMY")
+}
+
+func TestTimerReuse(t *testing.T) {
+	var tm timer
+	defer tm.stop()
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		assert.NoError(t, tm.sleep(context.Background(), time.Millisecond*10))
+		assert.True(t, time.Since(start) >= time.Millisecond*10)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, tm.sleep(ctx, time.Minute))
+
+	start := time.Now()
+	assert.NoError(t, tm.sleep(context.Background(), time.Millisecond*10))
+	assert.True(t, time.Since(start) >= time.Millisecond*10)
+}
+
+func TestRetryerRand(t *testing.T) {
+	delays := func() []time.Duration {
+		s := &fakeSleeper{}
+		r := mustRetryer(
+			WithInitialJitter(time.Second),
+			WithRand(rand.New(rand.NewSource(42))),
+			WithSleeper(s))
+		for i := 0; i < 5; i++ {
+			r.Do(func() error { return nil })
+		}
+		return s.delays
+	}
+	first := delays()
+	assert.Equal(t, 5, len(first))
+	assert.Equal(t, first, delays())
+}
+
+func TestRetryerRandomizationFactor(t *testing.T) {
+	period := time.Millisecond * 100
+	delays := func(opts ...Option) []time.Duration {
+		s := &fakeSleeper{}
+		opts = append(opts, WithMaxAttempts(50), WithRand(rand.New(rand.NewSource(1))), WithSleeper(s))
+		mustRetryer(opts...).Do(func() error { return errors.Errorf("DUMMY") })
+		return s.delays
+	}
+	ds := delays(WithPeriod(period), WithRandomizationFactor(0.5))
+	varied := false
+	for _, d := range ds {
+		assert.True(t, d >= period/2 && d <= period*3/2, d)
+		varied = varied || d != period
+	}
+	assert.True(t, varied)
+	assert.Equal(t, ds, delays(WithPeriod(period), WithRandomizationFactor(0.5)))
+
+	// randomized after the cap, so it does not flatten at it.
+	ds = delays(WithPeriod(period), WithMultiplier(2), WithMaxInterval(period*4), WithRandomizationFactor(0.5))
+	for _, d := range ds[5:] {
+		assert.True(t, d >= period*2 && d <= period*6, d)
+	}
+	assert.NotEqual(t, ds[10], ds[11])
+
+	for _, d := range delays(WithPeriod(period), WithRandomizationFactor(0)) {
+		assert.Equal(t, period, d)
+	}
+
+	for _, factor := range []float64{-0.1, 1.1, math.NaN()} {
+		_, err := NewRetryer(WithRandomizationFactor(factor))
+		assert.True(t, errors.Is(err, ErrInvalidOption))
+	}
+}
+
+func TestRetryerRandConcurrent(t *testing.T) {
+	r := mustRetryer(
+		WithInitialJitter(time.Microsecond),
+		WithRand(rand.New(rand.NewSource(1))))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Do(func() error { return nil })
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRetryerMaxInterval(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(8),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond * 100, Multiplier: 2}),
+		WithMaxInterval(time.Second),
+		WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{100 * ms, 200 * ms, 400 * ms, 800 * ms, time.Second, time.Second, time.Second}, s.delays)
+
+	_, err := NewRetryer(WithMaxInterval(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestRetryerMaxIntervalRetryAfter(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(2),
+		WithPeriod(time.Millisecond),
+		WithMaxInterval(time.Millisecond*10),
+		WithSleeper(s)).
+		Do(func() error { return &tooManyRequests{after: time.Second} })
+	assert.Equal(t, []time.Duration{time.Second}, s.delays)
+}
+
+func TestRetryerErrorWrapping(t *testing.T) {
+	errDummy := errors.New("DUMMY")
+	var seen []string
+	err := mustRetryer(
+		WithMaxAttempts(2),
+		WithErrorWrapping(),
+		WithOnError(func(err error) { seen = append(seen, err.Error()) }),
+		WithSleeper(&fakeSleeper{})).
+		Do(func() error { return errDummy })
+	assert.EqualError(t, err, "attempt 2/2: DUMMY")
+	assert.True(t, errors.Is(err, errDummy))
+	assert.Equal(t, []string{"attempt 1/2: DUMMY", "attempt 2/2: DUMMY"}, seen)
+
+	var sum int64
+	err = mustRetryer(WithErrorWrapping(), WithSleeper(&fakeSleeper{})).Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return errDummy
+		}
+		return Permanent(errDummy)
+	})
+	assert.EqualError(t, err, "attempt 3: DUMMY")
+}
+
+func TestRetryerErrorWrappingPanic(t *testing.T) {
+	var panics []interface{}
+	err := mustRetryer(
+		WithMaxAttempts(1),
+		WithErrorWrapping(),
+		WithPanicHandler(func(v interface{}) { panics = append(panics, v) })).
+		Do(func() error { panic("X") })
+	assert.EqualError(t, err, "attempt 1/1: recovered panic: X")
+	assert.True(t, IsPanic(err))
+	assert.Equal(t, []interface{}{"X"}, panics)
+
+	assert.PanicsWithValue(t, "X", func() {
+		mustRetryer(WithMaxAttempts(1), WithErrorWrapping(), WithRepanic()).
+			Do(func() error { panic("X") })
+	})
+}
+
+func TestRetryerOutcome(t *testing.T) {
+	r := mustRetryer(WithMaxAttempts(2), WithSleeper(&fakeSleeper{}))
+	assert.Equal(t, Succeeded, r.DoStats(func() error { return nil }).Outcome)
+	assert.Equal(t, Failed, r.DoStats(func() error { return errors.Errorf("DUMMY") }).Outcome)
+	assert.Equal(t, Panicked, r.DoStats(func() error { panic("X") }).Outcome)
+
+	var sum int64
+	st := r.DoStats(func() error {
+		if atomic.AddInt64(&sum, 1) == 1 {
+			panic("X")
+		}
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, Failed, st.Outcome)
+
+	st = mustRetryer(WithMaxAttempts(2), WithJoinErrors(), WithSleeper(&fakeSleeper{})).DoStats(func() error {
+		if atomic.AddInt64(&sum, 1) == 3 {
+			panic("X")
+		}
+		return errors.Errorf("DUMMY")
+	})
+	assert.Equal(t, Failed, st.Outcome)
+
+	assert.Equal(t, "succeeded", Succeeded.String())
+	assert.Equal(t, "failed", Failed.String())
+	assert.Equal(t, "panicked", Panicked.String())
+	assert.Equal(t, "Outcome(9)", Outcome(9).String())
+}
+
+func TestRetryerMultiplier(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(6),
+		WithPeriod(time.Millisecond*100),
+		WithMultiplier(1.5),
+		WithMaxInterval(time.Millisecond*400),
+		WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{100 * ms, 150 * ms, 225 * ms, 337500 * time.Microsecond, 400 * ms}, s.delays)
+
+	s = &fakeSleeper{}
+	mustRetryer(WithMaxAttempts(3), WithPeriod(time.Millisecond), WithMultiplier(1), WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Millisecond}, s.delays)
+
+	for _, factor := range []float64{0.5, 0, -2, math.NaN(), math.Inf(1)} {
+		_, err := NewRetryer(WithMultiplier(factor))
+		assert.True(t, errors.Is(err, ErrInvalidOption))
+	}
+}
+
+func TestRetryerMultiplierRounding(t *testing.T) {
+	s := &fakeSleeper{}
+	mustRetryer(
+		WithMaxAttempts(4),
+		WithPeriod(time.Duration(3)),
+		WithMultiplier(1.5),
+		WithSleeper(s)).
+		Do(func() error { return errors.Errorf("DUMMY") })
+	// 3, 4.5, 6.75 nanoseconds, rounded to the nearest one.
+	assert.Equal(t, []time.Duration{3, 5, 7}, s.delays)
+}
+
+func TestRetryerResetAfter(t *testing.T) {
+	s := &fakeSleeper{}
+	var sum int64
+	mustRetryer(
+		WithMaxAttempts(6),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond, Multiplier: 2}),
+		WithResetAfter(time.Millisecond*30),
+		WithSleeper(s)).
+		Do(func() error {
+			if atomic.AddInt64(&sum, 1) == 4 {
+				time.Sleep(time.Millisecond * 40)
+			}
+			return errors.Errorf("DUMMY")
+		})
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{1 * ms, 2 * ms, 4 * ms, 1 * ms, 2 * ms}, s.delays)
+
+	_, err := NewRetryer(WithResetAfter(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+type callKey struct{}
+
+// callSleeper records the delays of each call, by the callKey of its
+// context; and blocks the first sleep of the call named block, until
+// unblock is closed.
+type callSleeper struct {
+	mu      sync.Mutex
+	delays  map[string][]time.Duration
+	block   string
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (s *callSleeper) Sleep(ctx context.Context, d time.Duration) error {
+	call := ctx.Value(callKey{}).(string)
+	s.mu.Lock()
+	s.delays[call] = append(s.delays[call], d)
+	first := len(s.delays[call]) == 1
+	s.mu.Unlock()
+	if call == s.block && first {
+		close(s.blocked)
+		<-s.unblock
+	}
+	return ctx.Err()
+}
+
+func TestRetryerConcurrentStatefulBackoff(t *testing.T) {
+	base, limit := time.Millisecond, time.Hour
+	s := &callSleeper{
+		delays:  map[string][]time.Duration{},
+		block:   "A",
+		blocked: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithBackoff(&DecorrelatedJitterBackoff{Base: base, Cap: limit, Rand: rand.New(rand.NewSource(1))}),
+		WithSleeper(s))
+	fail := func(context.Context) error { return errors.Errorf("DUMMY") }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.DoContext(context.WithValue(context.Background(), callKey{}, "A"), fail)
+	}()
+	<-s.blocked
+	// B starts, and runs all its attempts, while A sleeps.
+	r.DoContext(context.WithValue(context.Background(), callKey{}, "B"), fail)
+	close(s.unblock)
+	<-done
+
+	// the same draws, from the same source, with a backoff for each call.
+	rnd := rand.New(rand.NewSource(1))
+	a := &DecorrelatedJitterBackoff{Base: base, Cap: limit, Rand: rnd}
+	b := &DecorrelatedJitterBackoff{Base: base, Cap: limit, Rand: rnd}
+	a1 := a.NextBackOff(1)
+	b1, b2 := b.NextBackOff(1), b.NextBackOff(2)
+	a2 := a.NextBackOff(2)
+	assert.Equal(t, []time.Duration{a1, a2}, s.delays["A"])
+	assert.Equal(t, []time.Duration{b1, b2}, s.delays["B"])
+}
+
+func TestRetryerConcurrent(t *testing.T) {
+	var calls, giveUps int64
+	r := mustRetryer(
+		WithMaxAttempts(3),
+		WithBackoff(&DecorrelatedJitterBackoff{Base: time.Microsecond, Cap: time.Millisecond, Rand: rand.New(rand.NewSource(1))}),
+		WithCircuitBreaker(1000, time.Millisecond),
+		WithInitialJitter(time.Microsecond),
+		WithRand(rand.New(rand.NewSource(1))),
+		WithOnGiveUp(func(error) { atomic.AddInt64(&giveUps, 1) }))
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st := r.DoStats(func() error {
+				atomic.AddInt64(&calls, 1)
+				if i%2 == 0 {
+					return nil
+				}
+				return errors.Errorf("DUMMY")
+			})
+			if i%2 == 0 {
+				assert.Equal(t, 1, st.Attempts)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int64(25+25*3), atomic.LoadInt64(&calls))
+	assert.Equal(t, int64(25), atomic.LoadInt64(&giveUps))
+}
+
+func TestRetryerDelayHook(t *testing.T) {
+	s := &fakeSleeper{}
+	var planned []time.Duration
+	var notified []time.Duration
+	r := mustRetryer(
+		WithMaxAttempts(4),
+		WithPeriod(time.Millisecond*10),
+		WithDelayHook(func(attempt int, d time.Duration) time.Duration {
+			planned = append(planned, d)
+			switch attempt {
+			case 1:
+				return d * 3
+			case 2:
+				return -time.Second
+			}
+			return d
+		}),
+		WithSleeper(s),
+		WithNotify(func(_ error, _ int, next time.Duration) { notified = append(notified, next) }))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{10 * ms, 10 * ms, 10 * ms}, planned)
+	assert.Equal(t, []time.Duration{30 * ms, 0, 10 * ms}, s.delays)
+	assert.Equal(t, []time.Duration{30 * ms, 0, 10 * ms, 0}, notified)
+}
+
+func TestRetryerDelayHookPanic(t *testing.T) {
+	assert.PanicsWithValue(t, "HOOK", func() {
+		mustRetryer(
+			WithMaxAttempts(2),
+			WithDelayHook(func(int, time.Duration) time.Duration { panic("HOOK") })).
+			Do(func() error { return errors.Errorf("DUMMY") })
+	})
+}
+
+func TestRetryerEstimatedAttemptDuration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	var sum int64
+	start := time.Now()
+	err := mustRetryer(
+		WithPeriod(time.Millisecond*30),
+		WithEstimatedAttemptDuration(time.Millisecond*50)).
+		DoContext(ctx, func(context.Context) error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+	assert.EqualError(t, err, "DUMMY")
+	// 0ms, 30ms; after the second one, 30ms + 50ms would go past 100ms.
+	assert.Equal(t, int64(2), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*80)
+
+	_, err = NewRetryer(WithEstimatedAttemptDuration(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestRetryerEvents(t *testing.T) {
+	r := mustRetryer(WithMaxAttempts(2), WithPeriod(time.Millisecond), WithSleeper(&fakeSleeper{}))
+	r.Do(func() error { return errors.Errorf("NOBODY LISTENS") })
+
+	events := r.Events()
+	assert.Equal(t, events, r.Events())
+	errDummy := errors.New("DUMMY")
+	r.Do(func() error { return errDummy })
+	var sum int64
+	r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 2 {
+			return errDummy
+		}
+		return nil
+	})
+	var got []Event
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+	assert.Equal(t, []Event{
+		{Kind: EventFailed, Attempt: 1, Err: errDummy, Delay: time.Millisecond},
+		{Kind: EventFailed, Attempt: 2, Err: errDummy},
+		{Kind: EventGaveUp, Attempt: 2, Err: errDummy},
+		{Kind: EventFailed, Attempt: 1, Err: errDummy, Delay: time.Millisecond},
+		{Kind: EventSucceeded, Attempt: 2},
+	}, got)
+
+	assert.Equal(t, "failed", EventFailed.String())
+	assert.Equal(t, "succeeded", EventSucceeded.String())
+	assert.Equal(t, "gave up", EventGaveUp.String())
+	assert.Equal(t, "EventKind(5)", EventKind(5).String())
+}
+
+func TestRetryerEventsDropped(t *testing.T) {
+	r := mustRetryer(WithMaxAttempts(eventsBuffer*2), WithSleeper(&fakeSleeper{}))
+	events := r.Events()
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, eventsBuffer, len(events))
+}
+
+func TestRetryerRetryNow(t *testing.T) {
+	s := &fakeSleeper{}
+	var sum int64
+	err := mustRetryer(
+		WithMaxAttempts(5),
+		WithBackoff(&ExponentialBackoff{Period: time.Millisecond, Multiplier: 2}),
+		WithSleeper(s)).
+		Do(func() error {
+			switch atomic.AddInt64(&sum, 1) {
+			case 2:
+				return fmt.Errorf("token refreshed: %w", ErrRetryNow)
+			case 4:
+				return nil
+			}
+			return errors.Errorf("DUMMY")
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), sum)
+	assert.Equal(t, []time.Duration{time.Millisecond, 0, time.Millisecond * 4}, s.delays)
+}
+
+func TestRetryRetryNow(t *testing.T) {
+	var sum int64
+	start := time.Now()
+	err := Retry(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return ErrRetryNow
+		}
+		return nil
+	}, 3, nil, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+}
+
+func TestRetryerErrorSampling(t *testing.T) {
+	var reported []string
+	r := mustRetryer(
+		WithMaxAttempts(10),
+		WithErrorSampling(4),
+		WithOnError(func(err error) { reported = append(reported, err.Error()) }),
+		WithSleeper(&fakeSleeper{}))
+	var sum int64
+	r.Do(func() error {
+		return errors.Errorf("DUMMY %d", atomic.AddInt64(&sum, 1))
+	})
+	assert.Equal(t, []string{"DUMMY 1", "DUMMY 4", "DUMMY 8", "DUMMY 10"}, reported)
+
+	// the count is local to each call.
+	reported, sum = nil, 0
+	r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) == 6 {
+			return nil
+		}
+		return errors.Errorf("DUMMY %d", sum)
+	})
+	assert.Equal(t, []string{"DUMMY 1", "DUMMY 4"}, reported)
+
+	var panics int
+	mustRetryer(
+		WithMaxAttempts(5),
+		WithErrorSampling(2),
+		WithPanicHandler(func(interface{}) { panics++ }),
+		WithSleeper(&fakeSleeper{})).
+		Do(func() error { panic("X") })
+	assert.Equal(t, 4, panics)
+}
+
+func TestRetryerMinAttempts(t *testing.T) {
+	var sum int64
+	start := time.Now()
+	mustRetryer(
+		WithPeriod(time.Millisecond*50),
+		WithMaxElapsedTime(time.Millisecond*10),
+		WithMinAttempts(4)).
+		Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+	assert.Equal(t, int64(4), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*40)
+
+	sum = 0
+	mustRetryer(WithMaxAttempts(2), WithMinAttempts(4), WithSleeper(&fakeSleeper{})).
+		Do(func() error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+	assert.Equal(t, int64(2), sum)
+
+	_, err := NewRetryer(WithMinAttempts(-1))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestRetryerMinAttemptsContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var sum int64
+	err := mustRetryer(WithMaxAttempts(5), WithPeriod(time.Minute), WithMinAttempts(3)).
+		DoContext(ctx, func(context.Context) error {
+			atomic.AddInt64(&sum, 1)
+			return errors.Errorf("DUMMY")
+		})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(3), sum)
+}
+
+func TestRetryerDefaultPeriod(t *testing.T) {
+	delays := func(opts ...Option) []time.Duration {
+		s := &fakeSleeper{}
+		opts = append(opts, WithMaxAttempts(2), WithSleeper(s))
+		mustRetryer(opts...).Do(func() error { return errors.Errorf("DUMMY") })
+		return s.delays
+	}
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{DefaultPeriod()}, delays())
+	assert.Equal(t, []time.Duration{7 * ms}, delays(WithDefaultPeriod(7*ms)))
+	assert.Equal(t, []time.Duration{0}, delays(WithPeriod(0), WithDefaultPeriod(7*ms)))
+	assert.Equal(t, []time.Duration{0}, delays(WithDefaultPeriod(7*ms), WithPeriod(0)))
+	assert.Equal(t, []time.Duration{3 * ms}, delays(WithDefaultPeriod(7*ms), WithPeriod(3*ms)))
+	assert.Equal(t, []time.Duration{DefaultPeriod()}, delays(WithDefaultPeriod(0)))
+
+	_, err := NewRetryer(WithDefaultPeriod(-time.Second))
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestRetryerWrap(t *testing.T) {
+	var calls int
+	r := mustRetryer(WithMaxAttempts(3), WithPeriod(time.Millisecond))
+	f := r.Wrap(func() error {
+		calls++
+		return errors.Errorf("DUMMY %d", calls)
+	})
+	assert.Equal(t, 0, calls)
+	assert.EqualError(t, f(), "DUMMY 3")
+	assert.EqualError(t, f(), "DUMMY 6")
+	assert.Equal(t, 6, calls)
+
+	calls = 0
+	f = r.Wrap(func() error {
+		if calls++; calls < 2 {
+			return errors.Errorf("DUMMY")
+		}
+		return nil
+	})
+	assert.NoError(t, f())
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryerExhaustedError(t *testing.T) {
+	errDummy := errors.New("DUMMY")
+	r := mustRetryer(WithMaxAttempts(3), WithSleeper(&fakeSleeper{}), WithExhaustedError())
+	err := r.Do(func() error { return errDummy })
+	assert.EqualError(t, err, "retry: retries exhausted after 3 attempts: DUMMY")
+	assert.True(t, errors.Is(err, ErrExhausted))
+	assert.True(t, errors.Is(err, errDummy))
+
+	err = r.Do(func() error { return Permanent(errDummy) })
+	assert.Equal(t, errDummy, err)
+
+	err = mustRetryer(WithMaxAttempts(3), WithSleeper(&fakeSleeper{}), WithExhaustedError(),
+		WithRetryIf(func(error) bool { return false })).Do(func() error { return errDummy })
+	assert.Equal(t, errDummy, err)
+
+	err = mustRetryer(WithMaxAttempts(2), WithSleeper(&fakeSleeper{}), WithExhaustedError(), WithJoinErrors()).
+		Do(func() error { return errDummy })
+	assert.True(t, errors.Is(err, ErrExhausted))
+	assert.EqualError(t, err, "retry: retries exhausted after 2 attempts: DUMMY\nDUMMY")
+
+	err = mustRetryer(WithMaxAttempts(2), WithSleeper(&fakeSleeper{})).Do(func() error { return errDummy })
+	assert.Equal(t, errDummy, err)
+}
+
+func TestRetryerNotify(t *testing.T) {
+	s := &fakeSleeper{}
+	var (
+		attempts []int
+		nexts    []time.Duration
+		errs     int
+	)
+	r := mustRetryer(
+		WithMaxAttempts(4),
+		WithBackoff(&ExponentialBackoff{
+			Period:              time.Millisecond * 10,
+			Multiplier:          2,
+			RandomizationFactor: 0.5,
+			Rand:                rand.New(rand.NewSource(1)),
+		}),
+		WithSleeper(s),
+		WithOnError(func(error) { errs++ }),
+		WithNotify(func(err error, attempt int, next time.Duration) {
+			assert.EqualError(t, err, "DUMMY")
+			attempts = append(attempts, attempt)
+			nexts = append(nexts, next)
+		}))
+	r.Do(func() error { return errors.Errorf("DUMMY") })
+	assert.Equal(t, []int{1, 2, 3, 4}, attempts)
+	assert.Equal(t, append(s.delays, 0), nexts)
+	assert.Equal(t, 4, errs)
+}
+
+func TestRetryerZeroPeriod(t *testing.T) {
+	var sum int64
+	start := time.Now()
+	err := mustRetryer(WithMaxAttempts(100), WithPeriod(0)).Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	})
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(100), sum)
+	assert.True(t, time.Since(start) < time.Millisecond*100)
+}
+
+func TestRetryerRetryIf(t *testing.T) {
+	var sum, errs int64
+	permanent := errors.Errorf("BAD REQUEST")
+	startedAt := time.Now()
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithPeriod(time.Second),
+		WithOnError(func(error) { atomic.AddInt64(&errs, 1) }),
+		WithRetryIf(func(err error) bool { return err != permanent }))
+	err := r.Do(func() error {
+		atomic.AddInt64(&sum, 1)
+		return permanent
+	})
+	assert.Equal(t, permanent, err)
+	assert.Equal(t, int64(1), sum)
+	assert.Equal(t, int64(1), errs)
+	assert.True(t, time.Since(startedAt) < time.Millisecond*100)
+}
+
+func TestRetryerRetryIfTransient(t *testing.T) {
+	var sum int64
+	transient := errors.Errorf("UNAVAILABLE")
+	r := mustRetryer(
+		WithMaxAttempts(5),
+		WithPeriod(time.Millisecond*10),
+		WithRetryIf(func(err error) bool { return err == transient }))
+	err := r.Do(func() error {
+		if atomic.AddInt64(&sum, 1) < 3 {
+			return transient
+		}
+		return errors.Errorf("BAD REQUEST")
+	})
+	assert.EqualError(t, err, "BAD REQUEST")
+	assert.Equal(t, int64(3), sum)
+}
+
+func ExampleRetryer() {
+	r, err := NewRetryer(
+		WithMaxAttempts(3),
+		WithPeriod(time.Millisecond*50),
+		WithOnError(func(err error) { fmt.Println(err) }))
+	if err != nil {
+		panic(err)
+	}
+	err = r.Do(func() error {
+		return errors.Errorf("FAILED")
+	})
+	fmt.Println(err)
+
+	// Output:
+	// FAILED
+	// FAILED
+	// FAILED
+	// FAILED
+}
+
+func TestRetryerDoNoAllocs(t *testing.T) {
+	f := func() error { return nil }
+	for _, r := range []*Retryer{
+		mustRetryer(WithMaxAttempts(1)),
+		mustRetryer(WithMaxAttempts(1), WithNoRecover()),
+	} {
+		allocs := testing.AllocsPerRun(100, func() { r.Do(f) })
+		assert.Equal(t, float64(0), allocs)
+	}
+}
+
+func BenchmarkRetryerDo(b *testing.B) {
+	r := mustRetryer(WithMaxAttempts(1))
+	f := func() error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Do(f)
+	}
+}
+
+func BenchmarkRetryerDoNoRecover(b *testing.B) {
+	r := mustRetryer(WithMaxAttempts(1), WithNoRecover())
+	f := func() error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Do(f)
+	}
+}
+
+func BenchmarkSleep(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sleep(ctx, time.Nanosecond)
+	}
+}
+
+func BenchmarkTimerSleep(b *testing.B) {
+	ctx := context.Background()
+	var t timer
+	defer t.stop()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		t.sleep(ctx, time.Nanosecond)
+	}
+}
@@ -0,0 +1,209 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ScheduleAtFixedRate runs f, times times, starting a run every period,
+// measured from the start of the previous run; so the time f takes does not
+// push the schedule back. If a run takes longer than period, the next one
+// starts immediately. If times < 0, it runs forever. It stops at the first
+// failed run, returning its error; panics are recovered as errors.
+// If period <= 0, DefaultPeriod() is used.
+func ScheduleAtFixedRate(f func() error, period time.Duration, times int) error {
+	s := &scheduler{period: period, times: times, fixedRate: true}
+	_, err := s.run(context.Background(), f)
+	return err
+}
+
+// ScheduleWithFixedDelay works like ScheduleAtFixedRate, but sleeps period
+// after each run ends; so the time between two runs is period plus the time
+// f takes.
+func ScheduleWithFixedDelay(f func() error, period time.Duration, times int) error {
+	s := &scheduler{period: period, times: times}
+	_, err := s.run(context.Background(), f)
+	return err
+}
+
+// ScheduleCount runs f, times times, starting a run every period, like
+// ScheduleAtFixedRate; but a failed run does not stop the schedule. It
+// returns once all runs are done, how many of them succeeded, and the error
+// of the last failed one, if any. Panics are recovered as errors.
+// If times < 0, it runs forever; unless stopped by
+// WithMaxConsecutiveFailures. If period <= 0, DefaultPeriod() is used.
+func ScheduleCount(
+	f func() error,
+	period time.Duration,
+	times int,
+	opts ...ScheduleOption) (runs int, lastErr error) {
+	s := &scheduler{
+		period:    period,
+		times:     times,
+		fixedRate: true,
+		keepGoing: true,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s.run(context.Background(), f)
+}
+
+// RunEvery runs f in a goroutine, times times, starting a run every period,
+// like ScheduleAtFixedRate; but a failed run does not stop the schedule,
+// its error is passed to onError, and the next run starts on time.
+// Each run is recovered on its own, so a panic does not stop it either;
+// see WithSchedulePanicHandler. If times < 0, it runs forever.
+// If period <= 0, DefaultPeriod() is used. It returns a function to stop
+// the schedule, after the current run, or while sleeping. Calling stop more
+// than once, or from other goroutines, is safe.
+func RunEvery(
+	period time.Duration,
+	times int,
+	f func() error,
+	onError func(error),
+	opts ...ScheduleOption) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scheduler{
+		period:    period,
+		times:     times,
+		fixedRate: true,
+		keepGoing: true,
+		onError:   onError,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	go func() {
+		defer cancel()
+		s.run(ctx, f)
+	}()
+	return cancel
+}
+
+// ScheduleResult works like RunEvery, for a function that returns a value;
+// the value of each successful run is sent on the returned channel, which
+// is closed once the schedule ends. A run waits for its value to be
+// received, or the schedule to be stopped, before the next one starts.
+func ScheduleResult[T any](
+	period time.Duration,
+	times int,
+	f func() (T, error),
+	onError func(error),
+	opts ...ScheduleOption) (<-chan T, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scheduler{
+		period:    period,
+		times:     times,
+		fixedRate: true,
+		keepGoing: true,
+		onError:   onError,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	results := make(chan T)
+	go func() {
+		defer close(results)
+		defer cancel()
+		s.run(ctx, func() error {
+			v, err := f()
+			if err != nil {
+				return err
+			}
+			select {
+			case results <- v:
+			case <-ctx.Done():
+			}
+			return nil
+		})
+	}()
+	return results, cancel
+}
+
+// ScheduleOption configures RunEvery, ScheduleResult, and ScheduleCount.
+type ScheduleOption func(*scheduler)
+
+// WithMaxConsecutiveFailures makes the schedule stop once n runs in a row
+// have failed, and call onGiveUp with the error of the last one, if it
+// is not nil. A successful run starts the count over. If n <= 0, it never
+// stops because of failures.
+func WithMaxConsecutiveFailures(n int, onGiveUp func(lastErr error)) ScheduleOption {
+	return func(s *scheduler) {
+		s.maxFailures = n
+		s.onGiveUp = onGiveUp
+	}
+}
+
+// WithSchedulePanicHandler sets a function to be called with the recovered
+// value of each run that panicked, instead of onError. A panic does not
+// stop RunEvery, or ScheduleResult, more than any other failed run does.
+// If onPanic is nil, panics are passed to onError, as errors.
+func WithSchedulePanicHandler(onPanic func(interface{})) ScheduleOption {
+	return func(s *scheduler) {
+		s.onPanic = onPanic
+	}
+}
+
+type scheduler struct {
+	period      time.Duration
+	times       int
+	fixedRate   bool
+	keepGoing   bool
+	onError     func(error)
+	onPanic     func(interface{})
+	maxFailures int
+	onGiveUp    func(lastErr error)
+}
+
+// run runs f until it has run s.times times, or a run fails, unless
+// s.keepGoing is set, or ctx is done. It returns the number of successful
+// runs, and the error of the last failed one.
+func (s *scheduler) run(ctx context.Context, f func() error) (runs int, lastErr error) {
+	period := s.period
+	if period <= 0 {
+		period = DefaultPeriod()
+	}
+	var t timer
+	defer t.stop()
+	failures := 0
+	for times := s.times; times != 0 && ctx.Err() == nil; {
+		if times > 0 {
+			times--
+		}
+		startedAt := time.Now()
+		if err := Try(f); err != nil {
+			lastErr = err
+			var pe *PanicError
+			if s.onPanic != nil && errors.As(err, &pe) {
+				s.onPanic(pe.Value)
+			} else if s.onError != nil {
+				s.onError(err)
+			}
+			if !s.keepGoing {
+				return runs, err
+			}
+			if failures++; s.maxFailures > 0 && failures >= s.maxFailures {
+				if s.onGiveUp != nil {
+					s.onGiveUp(err)
+				}
+				return runs, err
+			}
+		} else {
+			runs++
+			failures = 0
+		}
+		if times == 0 {
+			break
+		}
+		d := period
+		if s.fixedRate {
+			d -= time.Since(startedAt)
+		}
+		if d > 0 {
+			t.sleep(ctx, d)
+		}
+	}
+	return runs, lastErr
+}
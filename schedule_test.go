@@ -0,0 +1,252 @@
+package retry
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleAtFixedRate(t *testing.T) {
+	var starts []time.Time
+	err := ScheduleAtFixedRate(func() error {
+		starts = append(starts, time.Now())
+		time.Sleep(time.Millisecond * 30)
+		return nil
+	}, time.Millisecond*50, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(starts))
+	for i := 1; i < len(starts); i++ {
+		assert.InDelta(t, float64(time.Millisecond*50), float64(starts[i].Sub(starts[i-1])), float64(time.Millisecond*15))
+	}
+}
+
+func TestScheduleAtFixedRateOverrun(t *testing.T) {
+	var starts []time.Time
+	ScheduleAtFixedRate(func() error {
+		starts = append(starts, time.Now())
+		time.Sleep(time.Millisecond * 40)
+		return nil
+	}, time.Millisecond*20, 3)
+	assert.Equal(t, 3, len(starts))
+	for i := 1; i < len(starts); i++ {
+		assert.InDelta(t, float64(time.Millisecond*40), float64(starts[i].Sub(starts[i-1])), float64(time.Millisecond*15))
+	}
+}
+
+func TestScheduleWithFixedDelay(t *testing.T) {
+	var starts []time.Time
+	err := ScheduleWithFixedDelay(func() error {
+		starts = append(starts, time.Now())
+		time.Sleep(time.Millisecond * 30)
+		return nil
+	}, time.Millisecond*50, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(starts))
+	for i := 1; i < len(starts); i++ {
+		assert.InDelta(t, float64(time.Millisecond*80), float64(starts[i].Sub(starts[i-1])), float64(time.Millisecond*15))
+	}
+}
+
+func TestScheduleStopsOnError(t *testing.T) {
+	var sum int64
+	err := ScheduleAtFixedRate(func() error {
+		if atomic.AddInt64(&sum, 1) == 2 {
+			panic("X")
+		}
+		return nil
+	}, time.Millisecond*10, -1)
+	assert.True(t, IsPanic(err))
+	assert.Equal(t, int64(2), sum)
+
+	sum = 0
+	err = ScheduleWithFixedDelay(func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, time.Millisecond*10, 5)
+	assert.EqualError(t, err, "DUMMY")
+	assert.Equal(t, int64(1), sum)
+}
+
+func ExampleScheduleAtFixedRate() {
+	startedAt := time.Now()
+	ScheduleAtFixedRate(func() error {
+		fmt.Println(time.Since(startedAt).Round(time.Millisecond * 10))
+		time.Sleep(time.Millisecond * 20)
+		return nil
+	}, time.Millisecond*50, 3)
+
+	// Output:
+	// 0s
+	// 50ms
+	// 100ms
+}
+
+func TestScheduleCount(t *testing.T) {
+	var sum int64
+	runs, err := ScheduleCount(func() error {
+		if n := atomic.AddInt64(&sum, 1); n%2 == 0 {
+			return errors.Errorf("DUMMY %d", n)
+		}
+		return nil
+	}, time.Millisecond*5, 5)
+	assert.Equal(t, 3, runs)
+	assert.EqualError(t, err, "DUMMY 4")
+	assert.Equal(t, int64(5), sum)
+
+	sum = 0
+	runs, err = ScheduleCount(func() error {
+		if atomic.AddInt64(&sum, 1) > 2 {
+			panic("X")
+		}
+		return nil
+	}, time.Millisecond*5, -1, WithMaxConsecutiveFailures(2, nil))
+	assert.Equal(t, 2, runs)
+	assert.True(t, IsPanic(err))
+	assert.Equal(t, int64(4), sum)
+}
+
+func ExampleScheduleCount() {
+	// run every 50 millisecond, for 3 times:
+	runs, err := ScheduleCount(func() error {
+		return nil
+	}, time.Millisecond*50, 3)
+
+	fmt.Println(runs, err)
+
+	// Output:
+	// 3 <nil>
+}
+
+func TestRunEvery(t *testing.T) {
+	var sum int64
+	var errs []error
+	done := make(chan struct{})
+	RunEvery(time.Millisecond*10, 4, func() error {
+		n := atomic.AddInt64(&sum, 1)
+		if n%2 == 0 {
+			return errors.Errorf("DUMMY %d", n)
+		}
+		return nil
+	}, func(err error) {
+		errs = append(errs, err)
+		if len(errs) == 2 {
+			close(done)
+		}
+	})
+	<-done
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&sum))
+	assert.Equal(t, 2, len(errs))
+	assert.EqualError(t, errs[0], "DUMMY 2")
+	assert.EqualError(t, errs[1], "DUMMY 4")
+}
+
+func TestRunEveryStop(t *testing.T) {
+	var sum int64
+	stop := RunEvery(time.Millisecond*10, -1, func() error {
+		atomic.AddInt64(&sum, 1)
+		return errors.Errorf("DUMMY")
+	}, nil)
+	time.Sleep(time.Millisecond * 55)
+	stop()
+	stop()
+	n := atomic.LoadInt64(&sum)
+	assert.True(t, n >= 4 && n <= 7)
+	time.Sleep(time.Millisecond * 30)
+	assert.Equal(t, n, atomic.LoadInt64(&sum))
+}
+
+func TestRunEveryMaxConsecutiveFailures(t *testing.T) {
+	var sum int64
+	gaveUp := make(chan error, 1)
+	RunEvery(time.Millisecond*5, -1, func() error {
+		n := atomic.AddInt64(&sum, 1)
+		if n == 3 {
+			return nil
+		}
+		return errors.Errorf("DUMMY %d", n)
+	}, nil, WithMaxConsecutiveFailures(3, func(err error) { gaveUp <- err }))
+	select {
+	case err := <-gaveUp:
+		assert.EqualError(t, err, "DUMMY 6")
+	case <-time.After(time.Second):
+		t.Fatal("did not give up")
+	}
+	time.Sleep(time.Millisecond * 20)
+	assert.Equal(t, int64(6), atomic.LoadInt64(&sum))
+}
+
+func TestRunEveryPanics(t *testing.T) {
+	var sum int64
+	panics := make(chan interface{}, 5)
+	done := make(chan struct{})
+	RunEvery(time.Millisecond*5, 5, func() error {
+		panic(atomic.AddInt64(&sum, 1))
+	}, func(error) {
+		t.Error("onError called for a panic")
+	}, WithSchedulePanicHandler(func(v interface{}) {
+		if panics <- v; len(panics) == 5 {
+			close(done)
+		}
+	}))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("did not run 5 times")
+	}
+	assert.Equal(t, int64(5), atomic.LoadInt64(&sum))
+	for i := int64(1); i <= 5; i++ {
+		assert.Equal(t, i, <-panics)
+	}
+
+	errs := make(chan error, 3)
+	RunEvery(time.Millisecond*5, 3, func() error {
+		panic("X")
+	}, func(err error) { errs <- err })
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			assert.True(t, IsPanic(err))
+		case <-time.After(time.Second):
+			t.Fatal("did not run 3 times")
+		}
+	}
+}
+
+func TestScheduleResult(t *testing.T) {
+	var sum int64
+	var errs []error
+	results, _ := ScheduleResult(time.Millisecond*5, 5, func() (int64, error) {
+		n := atomic.AddInt64(&sum, 1)
+		if n == 2 {
+			return 0, errors.Errorf("DUMMY %d", n)
+		}
+		if n == 4 {
+			panic("X")
+		}
+		return n * 10, nil
+	}, func(err error) { errs = append(errs, err) })
+	var got []int64
+	for v := range results {
+		got = append(got, v)
+	}
+	assert.Equal(t, []int64{10, 30, 50}, got)
+	assert.Equal(t, 2, len(errs))
+	assert.EqualError(t, errs[0], "DUMMY 2")
+	assert.True(t, IsPanic(errs[1]))
+}
+
+func TestScheduleResultStop(t *testing.T) {
+	results, stop := ScheduleResult(time.Millisecond*5, -1, func() (string, error) {
+		return "X", nil
+	}, nil)
+	assert.Equal(t, "X", <-results)
+	stop()
+	for range results {
+	}
+	stop()
+}